@@ -18,17 +18,9 @@ func flipHorizontalBytePixels(c byte) byte {
 	return (c >> 6) | (c << 6) | ((c >> 2) & (3 << 2)) | ((c << 2) & (3 << 4))
 }
 
-func buildBinFromMCM(ctx *cli.Context, output string, input string, flipHorizontalPixels bool) error {
-	mf, err := os.Open(input)
-	if err != nil {
-		return err
-	}
-	defer mf.Close()
-	dec, err := mcm.NewDecoder(mf)
-	if err != nil {
-		return err
-	}
-	// Write all data to a buffer
+// binData returns the raw data for all the characters in dec,
+// optionally flipping the order of the pixels in each row
+func binData(dec *mcm.Decoder, flipHorizontalPixels bool) []byte {
 	var buf bytes.Buffer
 	for ii := 0; ii < dec.NChars(); ii++ {
 		chr := dec.CharAt(ii)
@@ -38,9 +30,20 @@ func buildBinFromMCM(ctx *cli.Context, output string, input string, flipHorizont
 				data[jj] = flipHorizontalBytePixels(data[jj])
 			}
 		}
-		if _, err := buf.Write(data); err != nil {
-			return err
-		}
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func buildBinFromMCM(ctx *cli.Context, output string, input string, flipHorizontalPixels bool) error {
+	mf, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer mf.Close()
+	dec, err := mcm.NewDecoder(mf)
+	if err != nil {
+		return err
 	}
 	// Save to bin
 	f, err := openOutputFile(output)
@@ -48,7 +51,7 @@ func buildBinFromMCM(ctx *cli.Context, output string, input string, flipHorizont
 		return err
 	}
 	defer f.Close()
-	if _, err := f.Write(buf.Bytes()); err != nil {
+	if _, err := f.Write(binData(dec, flipHorizontalPixels)); err != nil {
 		return err
 	}
 	if err := f.Close(); err != nil {
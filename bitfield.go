@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	bitOrderLSB = "lsb"
+	bitOrderMSB = "msb"
+)
+
+// bitfieldField represents a field inside a bitfield
+type bitfieldField struct {
+	Name  string
+	Width uint
+	Value uint64
+}
+
+// bitfield packs several fields into one or more bytes. Fields
+// are packed in the order they're declared. With the lsb bit order
+// (the default, which matches the c type) the first field uses the
+// least significant bits of the first byte, while with msb it uses
+// the most significant ones. In YAML, a bitfield is declared as:
+//
+//	metadata:
+//	  - bits:
+//	      order: msb # optional
+//	      fields:
+//	        - {name: visible, width: 1, value: true}
+//	        - {name: mode, width: 3, value: 5}
+//	        - {name: reserved, width: 4, value: 0}
+type bitfield struct {
+	Order  string
+	Fields []*bitfieldField
+}
+
+func parseBitfield(v interface{}) (*bitfield, error) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("argument to bits must be a map, it's %T", v)
+	}
+	bf := &bitfield{Order: bitOrderLSB}
+	for k, v := range m {
+		switch k {
+		case "order":
+			s, ok := v.(string)
+			if !ok || (s != bitOrderLSB && s != bitOrderMSB) {
+				return nil, fmt.Errorf("bits order must be %s or %s, it's %v", bitOrderLSB, bitOrderMSB, v)
+			}
+			bf.Order = s
+		case "fields":
+			fields, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("bits fields must be a list, it's %T", v)
+			}
+			for ii, f := range fields {
+				field, err := parseBitfieldField(f)
+				if err != nil {
+					return nil, fmt.Errorf("bits field %d: %v", ii+1, err)
+				}
+				bf.Fields = append(bf.Fields, field)
+			}
+		default:
+			return nil, fmt.Errorf("unknown key %v in bits", k)
+		}
+	}
+	if len(bf.Fields) == 0 {
+		return nil, errors.New("bits requires at least one field")
+	}
+	return bf, nil
+}
+
+func parseBitfieldField(v interface{}) (*bitfieldField, error) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("field must be a map, it's %T", v)
+	}
+	f := &bitfieldField{}
+	var hasWidth, hasValue bool
+	for k, v := range m {
+		switch k {
+		case "name":
+			f.Name = fmt.Sprint(v)
+		case "width":
+			w, err := toInt64(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid width: %v", err)
+			}
+			if w < 1 || w > 64 {
+				return nil, fmt.Errorf("invalid width %d, must be in [1, 64]", w)
+			}
+			f.Width = uint(w)
+			hasWidth = true
+		case "value":
+			if b, ok := v.(bool); ok {
+				if b {
+					f.Value = 1
+				}
+			} else {
+				i, err := toInt64(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value: %v", err)
+				}
+				if i < 0 {
+					return nil, fmt.Errorf("invalid negative value %d", i)
+				}
+				f.Value = uint64(i)
+			}
+			hasValue = true
+		default:
+			return nil, fmt.Errorf("unknown key %v", k)
+		}
+	}
+	if !hasWidth {
+		return nil, errors.New("missing width")
+	}
+	if !hasValue {
+		return nil, errors.New("missing value")
+	}
+	if f.Width < 64 && f.Value >= 1<<f.Width {
+		return nil, fmt.Errorf("value %d in field %q doesn't fit in %d bits", f.Value, f.Name, f.Width)
+	}
+	return f, nil
+}
+
+// Bytes returns the packed bitfield. If the total width of the fields
+// is not a multiple of 8, an error is returned.
+func (bf *bitfield) Bytes() ([]byte, error) {
+	total := uint(0)
+	for _, f := range bf.Fields {
+		total += f.Width
+	}
+	if total%8 != 0 {
+		return nil, fmt.Errorf("bits fields add up to %d bits, must be a multiple of 8", total)
+	}
+	data := make([]byte, total/8)
+	pos := uint(0)
+	for _, f := range bf.Fields {
+		for ii := uint(0); ii < f.Width; ii++ {
+			var bit uint64
+			if bf.Order == bitOrderMSB {
+				// Most significant bit of the field goes first
+				bit = (f.Value >> (f.Width - 1 - ii)) & 1
+			} else {
+				bit = (f.Value >> ii) & 1
+			}
+			if bit != 0 {
+				if bf.Order == bitOrderMSB {
+					data[pos/8] |= 0x80 >> (pos % 8)
+				} else {
+					data[pos/8] |= 1 << (pos % 8)
+				}
+			}
+			pos++
+		}
+	}
+	return data, nil
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
@@ -27,21 +28,47 @@ type charMap map[int]*mcm.Char
 type namedFont struct {
 	Name  string
 	Chars charMap
+	// Hash identifies the output of the font, used to
+	// detect changes in the parents of cached fonts
+	Hash string
 }
 
 type buildOptions struct {
-	NoBlanks         bool
-	Margin           int
-	Columns          int
-	RemoveDuplicates bool
+	NoBlanks bool
+	Margin   int
+	Columns  int
+	// RemoveDuplicates, if non nil, removes the characters in
+	// the source which are equal to the ones in its parents
+	RemoveDuplicates *duplicateRemover
+	Outline          *outlineOptions
+	Defines          map[string]string
+	// Merge is the default merge mode for extra data files
+	Merge string
+	// DataReport, if non nil, receives the source of every
+	// byte range in the extra data of each built font
+	DataReport io.Writer
+	// Provenance, if non nil, receives the origin of every
+	// character in each built font
+	Provenance *provenanceReport
+	// Log is used for the messages while building a font
+	Log *prefixLogger
 }
 
 func newBuildOptions(ctx *cli.Context) (*buildOptions, error) {
+	defines, err := parseDefines(ctx.StringSlice("define"))
+	if err != nil {
+		return nil, err
+	}
+	merge, err := parseMergeMode(ctx.String("merge"))
+	if err != nil {
+		return nil, err
+	}
 	return &buildOptions{
-		NoBlanks:         ctx.Bool("no-blanks"),
-		Margin:           ctx.Int("margin"),
-		Columns:          ctx.Int("columns"),
-		RemoveDuplicates: ctx.Bool("remove-duplicates"),
+		NoBlanks: ctx.Bool("no-blanks"),
+		Margin:   ctx.Int("margin"),
+		Columns:  ctx.Int("columns"),
+		Defines:  defines,
+		Merge:    merge,
 	}, nil
 }
 
@@ -103,7 +130,7 @@ func parseFilenameCharacterNums(nonExt string, im image.Image) ([]int, error) {
 	return nums, nil
 }
 
-func loadFontFromDir(dir string) (charMap, error) {
+func loadFontFromDir(dir string, prov fontProvenance) (charMap, error) {
 	entries, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, err
@@ -157,7 +184,11 @@ func loadFontFromDir(dir string) (charMap, error) {
 					return nil, err
 				}
 				chars[chNum] = mcmCh
-
+				prov[chNum] = &charProvenance{
+					Source: originImage,
+					File:   filename,
+					Cell:   &charCell{Column: xc, Row: yc, X: x0, Y: y0},
+				}
 			}
 		}
 	}
@@ -168,7 +199,7 @@ type subImager interface {
 	SubImage(r image.Rectangle) image.Image
 }
 
-func loadFontFromPNG(filename string, opts *buildOptions) (charMap, error) {
+func loadFontFromPNG(filename string, opts *buildOptions, prov fontProvenance) (charMap, error) {
 	cols := opts.Columns
 	margin := opts.Margin
 	rows := int(math.Ceil(float64(mcm.CharNum) / float64(cols)))
@@ -226,22 +257,29 @@ func loadFontFromPNG(filename string, opts *buildOptions) (charMap, error) {
 			}
 			if !chr.IsBlank() {
 				chars[chNum] = chr
+				prov[chNum] = &charProvenance{
+					Source: originSheet,
+					File:   filename,
+					Cell:   &charCell{Column: ii, Row: jj, X: leftX, Y: topY},
+				}
 			}
 		}
 	}
 	return chars, nil
 }
 
-func loadFontFromInput(input string, opts *buildOptions) (charMap, error) {
+// loadFontFromInput loads the characters from a directory or a PNG,
+// recording the origin of each one in prov
+func loadFontFromInput(input string, opts *buildOptions, prov fontProvenance) (charMap, error) {
 	st, err := os.Stat(input)
 	if err != nil {
 		return nil, err
 	}
 	var chars charMap
 	if st.IsDir() {
-		chars, err = loadFontFromDir(input)
+		chars, err = loadFontFromDir(input, prov)
 	} else {
-		chars, err = loadFontFromPNG(input, opts)
+		chars, err = loadFontFromPNG(input, opts, prov)
 	}
 	if err != nil {
 		return nil, err
@@ -260,14 +298,34 @@ func charIsEqualEnough(src, dst *mcm.Char) bool {
 }
 
 func buildFromInput(output string, input string, fontData *fontDataSet, parents []*namedFont, opts *buildOptions) (charMap, error) {
-	chars, err := loadFontFromInput(input, opts)
+	chars, enc, err := resolveFontFromInput(output, input, fontData, parents, opts)
 	if err != nil {
 		return nil, err
 	}
+	if err := buildMCM(output, enc); err != nil {
+		return nil, err
+	}
+	return chars, nil
+}
+
+// resolveFontFromInput loads the font at input and fills it from its
+// parents and the extra data, returning its characters and an encoder
+// for them. output is only used for messages and the data report.
+func resolveFontFromInput(output string, input string, fontData *fontDataSet, parents []*namedFont, opts *buildOptions) (charMap, *mcm.Encoder, error) {
+	prov := make(fontProvenance)
+	chars, err := loadFontFromInput(input, opts, prov)
+	if err != nil {
+		return nil, nil, err
+	}
 	enc := &mcm.Encoder{
 		Chars: chars,
 		Fill:  !opts.NoBlanks,
 	}
+	if opts.Outline != nil {
+		if err := opts.Outline.Apply(chars, enc.CharNum(), opts.Log); err != nil {
+			return nil, nil, fmt.Errorf("error adding outline to %s: %v", input, err)
+		}
+	}
 
 	// Fill characters from parents (if any)
 
@@ -280,80 +338,84 @@ func buildFromInput(output string, input string, fontData *fontDataSet, parents
 			charNum = penc.CharNum()
 		}
 	}
+	var duplicates []duplicateChar
 	for ii := 0; ii < charNum; ii++ {
 		chr := chars[ii]
 		if chr != nil {
-			// Log a verbose message if this character is duplicated from any
+			// Record the character if it's duplicated from any parent
 			for _, p := range parents {
-				if pchr := p.Chars[ii]; pchr != nil {
-					if charIsEqualEnough(pchr, chr) {
-						if opts.RemoveDuplicates {
-							// We can only remove duplicates from the child if it's
-							// a directory, otherwise it gets too messy
-							if filepath.Ext(input) == "" {
-								filename := filepath.Join(input, fmt.Sprintf("%03d.png", ii))
-								if err := os.Remove(filename); err != nil {
-									logVerbose("could not remove duplicate character %03d in %s: %v", ii, input, err)
-								} else {
-									logVerbose("removed duplicate character %03d in %s, since it's equal to its parent %s",
-										ii, input, p.Name)
-								}
-
-							} else {
-								logVerbose("not removing duplicate character %03d in %s because the source is an image - switch to a directory based format to use this option",
-									ii, input)
-							}
-						} else {
-							logVerbose("character %03d in %s is equal to parent font %s and can be removed",
-								ii, input, p.Name)
-						}
-					}
+				if pchr := p.Chars[ii]; pchr != nil && charIsEqualEnough(pchr, chr) {
+					opts.Log.Verbose("character %03d in %s is equal to parent font %s and can be removed",
+						ii, input, p.Name)
+					duplicates = append(duplicates, duplicateChar{Char: ii, Parent: p.Name})
+					break
 				}
 			}
 		} else {
 			// Check if we can fill it from the parents
 			for _, p := range parents {
 				if pchr := p.Chars[ii]; pchr != nil {
-					logDebug("filling character %03d in %s from parent font %s", ii, output, p.Name)
+					opts.Log.Debug("filling character %03d in %s from parent font %s", ii, output, p.Name)
 					// Check if we have different metadata for this character in the child font.
 					// In that case, we overwrite it.
 					charData := fontData.Values()[ii]
 					if charData != nil {
 					}
 					chars[ii] = pchr
+					prov[ii] = &charProvenance{Source: originParent, Parent: p.Name}
 					break
 				}
 			}
 		}
 	}
 
+	if opts.RemoveDuplicates != nil && len(duplicates) > 0 {
+		if err := opts.RemoveDuplicates.Remove(duplicates, prov, opts.Log); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	// Apply extra font data
 	if fontData != nil {
 		for k, v := range fontData.Values() {
 			if prev, found := chars[k]; found {
-				repl, err := v.MergeTo(k, prev)
+				repl, err := v.MergeTo(k, prev, opts.Log)
 				if err != nil {
-					return nil, fmt.Errorf("error merging binary data into existing character %d: %v", k, err)
+					return nil, nil, fmt.Errorf("error merging binary data into existing character %d: %v", k, err)
 				}
 				chars[k] = repl
+				if p := prov[k]; p != nil {
+					p.MetadataMerged = len(v.Metadata) > 0
+				}
 			} else {
 				chr, err := v.Char()
 				if err != nil {
-					return nil, fmt.Errorf("error decoding binary character %d: %v", k, err)
+					return nil, nil, fmt.Errorf("error decoding binary character %d: %v", k, err)
 				}
-				logVerbose("creating new character %03d from extra data in font %s", k, input)
+				opts.Log.Verbose("creating new character %03d from extra data in font %s", k, input)
 				chars[k] = chr
+				prov[k] = &charProvenance{Source: originExtraData}
 			}
+			if p := prov[k]; p != nil {
+				for _, s := range v.Sources {
+					p.ExtraData = append(p.ExtraData, s.String())
+				}
+			}
+		}
+		if err := fontData.ResolveComputed(chars, enc.CharNum()); err != nil {
+			return nil, nil, fmt.Errorf("error computing extra data for %s: %v", output, err)
+		}
+		if err := writeDataReport(opts, output, fontData); err != nil {
+			return nil, nil, err
 		}
 	}
-
-	if err := buildMCM(output, enc); err != nil {
-		return nil, err
+	if opts.Provenance != nil {
+		opts.Provenance.Add(prov.Report(output, input, chars, enc.CharNum(), enc.Fill))
 	}
-	return chars, nil
+	return chars, enc, nil
 }
 
-func buildAction(ctx *cli.Context) error {
+func buildAction(ctx *cli.Context) (err error) {
 	if ctx.NArg() != 2 {
 		return errors.New("build requires 2 arguments, see help build")
 	}
@@ -363,12 +425,33 @@ func buildAction(ctx *cli.Context) error {
 	}
 	input := ctx.Args().Get(0)
 	output := ctx.Args().Get(1)
+	if report := ctx.String("data-report"); report != "" {
+		var f *os.File
+		if f, err = openOutputFile(report); err != nil {
+			return err
+		}
+		defer closeOutputFile(f, &err)
+		opts.DataReport = f
+	}
+	if provenance := ctx.String("provenance"); provenance != "" {
+		var f *os.File
+		if f, err = openOutputFile(provenance); err != nil {
+			return err
+		}
+		// Closed after the report is written, before returning
+		defer closeOutputFile(f, &err)
+		opts.Provenance = newProvenanceReport(f)
+	}
 	fontData := newFontDataSet()
+	fontData.Defines = opts.Defines
+	fontData.Merge = opts.Merge
 	for _, e := range ctx.StringSlice("extra") {
 		if err := fontData.ParseFile(e); err != nil {
 			return err
 		}
 	}
-	_, err = buildFromInput(output, input, fontData, nil, opts)
-	return err
+	if _, err := buildFromInput(output, input, fontData, nil, opts); err != nil {
+		return err
+	}
+	return opts.Provenance.Write()
 }
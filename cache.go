@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// cacheDirName is the directory inside the user cache directory
+	// where generate stores the cache for each config file
+	cacheDirName = "max7456tool"
+	cacheVersion = 2
+)
+
+// defaultCacheFile returns the cache file used for the given config
+// file when --cache is not provided. It's stored in the user cache
+// directory rather than next to the config, so it never ends up
+// mixed with the font sources.
+func defaultCacheFile(configFile string) (string, error) {
+	abs, err := filepath.Abs(configFile)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("%v, use --cache or --no-cache", err)
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, cacheDirName, hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// fontCacheEntry contains the hashes of the inputs used to generate
+// a font, as well as the hashes of the font and of its outputs.
+type fontCacheEntry struct {
+	Source    string `json:"source"`
+	ExtraData string `json:"extra"`
+	Parents   string `json:"parents"`
+	Options   string `json:"options"`
+	// Font is the hash of the font encoded as .mcm
+	Font string `json:"font"`
+	// Outputs contains the hash of each output, by path
+	Outputs map[string]string `json:"outputs"`
+}
+
+// RebuildReason returns why a font with the inputs in e needs to be
+// built again, given the entry stored in the cache for it. If the
+// font is up to date, it returns an empty string and the hashes of
+// the font and its outputs are copied from prev.
+func (e *fontCacheEntry) RebuildReason(prev *fontCacheEntry, outputs []*fontOutput) string {
+	if prev == nil {
+		return "not found in the cache"
+	}
+	switch {
+	case e.Source != prev.Source:
+		return "source files changed"
+	case e.ExtraData != prev.ExtraData:
+		return "extra data files changed"
+	case e.Parents != prev.Parents:
+		return "parent fonts changed"
+	case e.Options != prev.Options:
+		return "build options changed"
+	}
+	for _, o := range outputs {
+		expected, found := prev.Outputs[o.Path]
+		if !found {
+			return fmt.Sprintf("output %s is not in the cache", o.Path)
+		}
+		if h, err := hashFiles(o.Path); err != nil {
+			return fmt.Sprintf("output %s is not readable", o.Path)
+		} else if h != expected {
+			return fmt.Sprintf("output %s was modified", o.Path)
+		}
+	}
+	// Up to date, the outputs are the same
+	e.Font = prev.Font
+	e.Outputs = prev.Outputs
+	return ""
+}
+
+// newFontCacheEntry returns an entry with the hashes of the
+// inputs for building the font at source
+func newFontCacheEntry(source string, fontData *fontDataSet, parents []*namedFont, opts *buildOptions, outputs []*fontOutput) (*fontCacheEntry, error) {
+	var err error
+	entry := &fontCacheEntry{
+		Parents: hashParents(parents),
+		Options: hashBuildOptions(opts, outputs),
+	}
+	if entry.Source, err = hashFiles(source); err != nil {
+		return nil, err
+	}
+	if entry.ExtraData, err = hashFiles(fontData.Inputs...); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// buildCache is the manifest used by generate to skip fonts whose
+// inputs haven't changed since they were last built. It's safe
+// for concurrent use.
+type buildCache struct {
+	Filename string
+	// Rebuild forces all fonts to be built
+	Rebuild bool
+
+	mu    sync.Mutex
+	fonts map[string]*fontCacheEntry
+}
+
+type buildCacheFile struct {
+	Version int                        `json:"version"`
+	Fonts   map[string]*fontCacheEntry `json:"fonts"`
+}
+
+// loadBuildCache loads the cache manifest from filename. If the file
+// doesn't exist or it can't be used, an empty cache is returned.
+func loadBuildCache(filename string) (*buildCache, error) {
+	c := &buildCache{
+		Filename: filename,
+		fonts:    make(map[string]*fontCacheEntry),
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	var f buildCacheFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		logVerbose("ignoring invalid cache %s: %v", filename, err)
+		return c, nil
+	}
+	if f.Version != cacheVersion {
+		logVerbose("ignoring cache %s with version %d", filename, f.Version)
+		return c, nil
+	}
+	for k, v := range f.Fonts {
+		if v != nil {
+			c.fonts[k] = v
+		}
+	}
+	return c, nil
+}
+
+// RebuildReason returns why the given font needs to be built, with
+// entry containing the hashes of its current inputs. If the font is
+// up to date, it returns an empty string.
+func (c *buildCache) RebuildReason(name string, entry *fontCacheEntry, outputs []*fontOutput) string {
+	if c.Rebuild {
+		return "--rebuild was given"
+	}
+	c.mu.Lock()
+	prev := c.fonts[name]
+	c.mu.Unlock()
+	return entry.RebuildReason(prev, outputs)
+}
+
+// Set stores the entry for the given font
+func (c *buildCache) Set(name string, entry *fontCacheEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fonts[name] = entry
+}
+
+// Save writes the cache manifest to its file
+func (c *buildCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.MarshalIndent(&buildCacheFile{Version: cacheVersion, Fonts: c.fonts}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Filename), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.Filename, append(data, '\n'), 0644)
+}
+
+// hashFiles returns a hash of the contents of the given files. For
+// directories, all the files inside them are hashed, including their
+// path relative to the directory.
+func hashFiles(paths ...string) (string, error) {
+	h := sha256.New()
+	hashFile := func(name string, p string) error {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %d\n", name, st.Size())
+		_, err = io.Copy(h, f)
+		return err
+	}
+	for _, p := range paths {
+		st, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		if !st.IsDir() {
+			if err := hashFile("", p); err != nil {
+				return "", err
+			}
+			continue
+		}
+		err = filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(p, path)
+			if err != nil {
+				return err
+			}
+			return hashFile(filepath.ToSlash(rel), path)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashBytes returns the same hash as hashFiles would
+// return for a file with the given data
+func hashBytes(data []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %d\n", "", len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashBuildOptions returns a hash of all the options which
+// might change the outputs when building a font
+func hashBuildOptions(opts *buildOptions, outputs []*fontOutput) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "version=%s\n", appVersion)
+	fmt.Fprintf(h, "no-blanks=%v margin=%d columns=%d\n", opts.NoBlanks, opts.Margin, opts.Columns)
+	fmt.Fprintf(h, "remove-duplicates=%v merge=%s\n", opts.RemoveDuplicates != nil, opts.Merge)
+	for _, o := range outputs {
+		fmt.Fprintf(h, "output %s=%q flip=%v scale=%d name=%q\n", o.Format(), o.Path, o.Config.Flip, o.Config.Scale, o.Config.Name)
+	}
+	if opts.Outline != nil {
+		fmt.Fprintf(h, "outline=%q/%d\n", opts.Outline.Chars, opts.Outline.Neighbors)
+	}
+	var keys []string
+	for k := range opts.Defines {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "define %q=%q\n", k, opts.Defines[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashParents returns a hash of the given parent fonts
+func hashParents(parents []*namedFont) string {
+	h := sha256.New()
+	for _, p := range parents {
+		fmt.Fprintf(h, "%q %s\n", p.Name, p.Hash)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadCachedFont loads the characters of a font which wasn't rebuilt
+// from its output. Blank characters are skipped, since they're
+// missing characters filled when encoding the font.
+func loadCachedFont(filename string) (charMap, error) {
+	dec, err := decodeMCMFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	chars := make(charMap)
+	for ii := 0; ii < dec.NChars(); ii++ {
+		chr := dec.CharAt(ii)
+		if chr.IsBlank() && chr.MetadataIsBlank() {
+			continue
+		}
+		chars[ii] = chr
+	}
+	return chars, nil
+}
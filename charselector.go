@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fiam/max7456tool/mcm"
+)
+
+const (
+	// symbolsKey is the top level key used to declare the symbol
+	// table for selecting characters by name in extra data files
+	symbolsKey = "symbols"
+)
+
+// parseCharSelector parses a key in an extra data file, which might
+// select several characters. Keys are lists of items separated by
+// commas, where each item might be:
+//
+//   - A character number, in decimal or in hex (e.g. 46 or 0x2e)
+//   - An inclusive range, using either - or .. (e.g. 0x10-0x1F or 160..255)
+//   - A symbol name from the symbol table (e.g. SYM_RSSI)
+//   - A glob matching symbol names (e.g. SYM_BATT_*)
+//
+// The returned characters are sorted and contain no duplicates.
+func parseCharSelector(key string, symbols *symbolTable) ([]int, error) {
+	seen := make(map[int]bool)
+	var chars []int
+	add := func(n int) {
+		if !seen[n] {
+			seen[n] = true
+			chars = append(chars, n)
+		}
+	}
+	for _, item := range strings.Split(key, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			return nil, fmt.Errorf("empty item in character selector %q", key)
+		}
+		if c := item[0]; c >= '0' && c <= '9' {
+			first, last, err := parseCharRange(strings.Replace(item, "..", "-", 1), mcm.ExtendedCharNum)
+			if err != nil {
+				return nil, err
+			}
+			for ii := first; ii <= last; ii++ {
+				add(ii)
+			}
+			continue
+		}
+		if symbols == nil {
+			return nil, fmt.Errorf("can't select symbol %q without a symbol table, declare it with %s: <file>", item, symbolsKey)
+		}
+		matched := false
+		for _, name := range symbols.Names() {
+			ok, err := path.Match(item, name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid symbol pattern %q: %v", item, err)
+			}
+			if ok {
+				n, _ := symbols.Lookup(name)
+				add(n)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("%q doesn't match any symbol in %s", item, symbols.Name)
+		}
+	}
+	sort.Ints(chars)
+	return chars, nil
+}
+
+// loadExtraDataSymbols loads the symbol table declared in an extra data
+// file. Relative paths are resolved relative to dir.
+func loadExtraDataSymbols(v interface{}, dir string) (*symbolTable, error) {
+	name, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a string, it's %T", symbolsKey, v)
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+	return loadSymbolTable(name)
+}
+
+// extraDataFile contains the parsed top level keys of an extra data file
+type extraDataFile struct {
+	// Chars contains the value for each character
+	Chars map[int]interface{}
+	// Keys contains the key that selected each character
+	Keys map[int]string
+	// Types contains the declared struct types
+	Types map[string]*structType
+	// Merge is the merge mode declared for the file, if any
+	Merge string
+}
+
+// splitExtraData separates the characters in an extra data file from
+// its other top level keys and expands the keys selecting several
+// characters. When a character is selected by more than one key, the
+// key selecting the fewest characters wins, so a single character key
+// always overrides a range. Keys selecting the same number of characters
+// can't overlap.
+func splitExtraData(raw map[interface{}]interface{}, dir string, source *yamlFile, log *prefixLogger) (*extraDataFile, error) {
+	f := &extraDataFile{
+		Chars: make(map[int]interface{}, len(raw)),
+		Keys:  make(map[int]string, len(raw)),
+	}
+	var symbols *symbolTable
+	var err error
+	if v, found := raw[typesKey]; found {
+		if f.Types, err = parseStructTypes(v, source); err != nil {
+			return nil, err
+		}
+	}
+	if v, found := raw[symbolsKey]; found {
+		if symbols, err = loadExtraDataSymbols(v, dir); err != nil {
+			return nil, source.Wrap(err, symbolsKey)
+		}
+	}
+	if v, found := raw[mergeKey]; found {
+		if f.Merge, err = parseMergeMode(v); err != nil {
+			return nil, source.Wrap(err, mergeKey)
+		}
+	}
+	counts := make(map[int]int)
+	for k, v := range raw {
+		var chars []int
+		switch x := k.(type) {
+		case int:
+			chars = []int{x}
+		case string:
+			if x == typesKey || x == symbolsKey || x == mergeKey {
+				continue
+			}
+			if chars, err = parseCharSelector(x, symbols); err != nil {
+				return nil, source.Wrap(fmt.Errorf("invalid key %q: %v", x, err), x)
+			}
+		default:
+			return nil, source.Wrap(fmt.Errorf("invalid key %v (%T)", k, k), k)
+		}
+		key := fmt.Sprint(k)
+		if vm, ok := v.(map[interface{}]interface{}); ok && vm["payload"] != nil && len(chars) > 1 {
+			return nil, source.Wrap(fmt.Errorf("key %q selects %d characters, payloads must start at a single one", key, len(chars)), key, "payload")
+		}
+		for _, n := range chars {
+			if prev := f.Keys[n]; prev != "" {
+				if counts[n] == len(chars) {
+					return nil, source.Wrap(fmt.Errorf("character %03d is selected by both %q and %q", n, prev, key), key)
+				}
+				if counts[n] < len(chars) {
+					log.Debug("character %03d: key %q overrides %q", n, prev, key)
+					continue
+				}
+				log.Debug("character %03d: key %q overrides %q", n, key, prev)
+			}
+			f.Keys[n] = key
+			counts[n] = len(chars)
+			f.Chars[n] = v
+		}
+	}
+	var keys []int
+	for k := range f.Keys {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		log.Debug("character %03d: data from key %q", k, f.Keys[k])
+	}
+	return f, nil
+}
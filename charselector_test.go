@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCharSelector(t *testing.T) {
+	symbols, err := loadSymbolTable("example_symbols.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		key      string
+		expected []int
+	}{
+		{key: "46", expected: []int{46}},
+		{key: "0x10-0x13", expected: []int{16, 17, 18, 19}},
+		{key: "160..162", expected: []int{160, 161, 162}},
+		{key: "SYM_RSSI", expected: []int{1}},
+		{key: "SYM_M*, SYM_VOLT", expected: []int{6, 7}},
+		{key: "3, 1-2, SYM_RSSI", expected: []int{1, 2, 3}},
+	}
+	for _, tc := range testCases {
+		chars, err := parseCharSelector(tc.key, symbols)
+		if err != nil {
+			t.Errorf("error parsing %q: %v", tc.key, err)
+			continue
+		}
+		if !reflect.DeepEqual(chars, tc.expected) {
+			t.Errorf("expecting %v for %q, got %v", tc.expected, tc.key, chars)
+		}
+	}
+	for _, key := range []string{"SYM_FOO*", "5-2", "1,,2", "0x10-0x200"} {
+		if _, err := parseCharSelector(key, symbols); err == nil {
+			t.Errorf("expecting an error for %q", key)
+		}
+	}
+}
+
+func TestSplitExtraDataOverrides(t *testing.T) {
+	const data = `
+symbols: example_symbols.yaml
+"0-9": {metadata: [{u8: 1}]}
+"5..7": {metadata: [{u8: 2}]}
+SYM_VOLT: {metadata: [{u8: 3}]}
+`
+	ef, err := splitExtraData(testDecodeYAMLMap(t, data), ".", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int]int{0: 1, 4: 1, 5: 2, 6: 3, 7: 2, 8: 1, 9: 1}
+	if len(ef.Chars) != 10 {
+		t.Errorf("expecting 10 characters, got %d", len(ef.Chars))
+	}
+	for n, value := range expected {
+		meta := ef.Chars[n].(map[interface{}]interface{})["metadata"].([]interface{})
+		if v := meta[0].(map[interface{}]interface{})["u8"]; v != value {
+			t.Errorf("expecting %d in character %d, got %v", value, n, v)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/fiam/max7456tool/mcm"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	asciiPrintableFirst = 0x21 // space is blank
+	asciiPrintableLast  = 0x7e
+)
+
+// parseRequiredChars parses a file with the characters required by
+// a firmware. Each line might contain a character selection as
+// accepted by parseCharSelection or, if symbols is non nil, a symbol
+// name. Empty lines and everything after a # are ignored.
+func parseRequiredChars(filename string, symbols *symbolTable, max int) ([]int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var required []int
+	for ii, line := range strings.Split(string(data), "\n") {
+		if p := strings.IndexByte(line, '#'); p >= 0 {
+			line = line[:p]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if symbols != nil {
+			if n, found := symbols.Lookup(line); found {
+				required = append(required, n)
+				continue
+			}
+		}
+		nums, err := parseCharSelection(line, max)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, ii+1, err)
+		}
+		required = append(required, nums...)
+	}
+	return required, nil
+}
+
+// checkResult contains the problems found by checkFont
+type checkResult struct {
+	// Missing contains the required characters which are blank
+	Missing []int
+	// Unused contains the non blank characters which are neither
+	// required nor printable ASCII
+	Unused []int
+	// MissingASCII contains the blank printable ASCII characters
+	MissingASCII []int
+}
+
+// checkFont checks that all the characters in required are present in
+// the font. It also reports the characters that are set but not
+// required and the printable ASCII characters which are missing.
+func checkFont(dec *mcm.Decoder, required map[int]bool) *checkResult {
+	res := &checkResult{}
+	for n := range required {
+		if n >= dec.NChars() || dec.CharAt(n).IsBlank() {
+			res.Missing = append(res.Missing, n)
+		}
+	}
+	sort.Ints(res.Missing)
+	for ii := 0; ii < dec.NChars(); ii++ {
+		isASCII := ii >= asciiPrintableFirst && ii <= asciiPrintableLast
+		if !required[ii] && !isASCII && !dec.CharAt(ii).IsBlank() {
+			res.Unused = append(res.Unused, ii)
+		}
+	}
+	for ii := asciiPrintableFirst; ii <= asciiPrintableLast; ii++ {
+		if dec.CharAt(ii).IsBlank() {
+			res.MissingASCII = append(res.MissingASCII, ii)
+		}
+	}
+	return res
+}
+
+func checkAction(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("check requires 1 argument, see help check")
+	}
+	firmware := ctx.String("firmware")
+	requiredFile := ctx.String("required")
+	if firmware == "" && requiredFile == "" {
+		return errors.New("check requires --firmware and/or --required")
+	}
+	input := ctx.Args().Get(0)
+	dec, err := decodeMCMFile(input)
+	if err != nil {
+		return err
+	}
+	var symbols *symbolTable
+	required := make(map[int]bool)
+	if firmware != "" {
+		if symbols, err = resolveSymbolTable(firmware, ctx.String("firmware-dir")); err != nil {
+			return err
+		}
+		for _, n := range symbols.Indices() {
+			required[n] = true
+		}
+	}
+	if requiredFile != "" {
+		nums, err := parseRequiredChars(requiredFile, symbols, dec.NChars())
+		if err != nil {
+			return err
+		}
+		for _, n := range nums {
+			required[n] = true
+		}
+	}
+	if ctx.Bool("require-ascii") {
+		for ii := asciiPrintableFirst; ii <= asciiPrintableLast; ii++ {
+			required[ii] = true
+		}
+	}
+
+	res := checkFont(dec, required)
+	for _, n := range res.Missing {
+		fmt.Printf("%s: missing required character %s\n", input, symbols.describe(n))
+	}
+	if len(res.Unused) > 0 {
+		var items []string
+		for _, n := range res.Unused {
+			items = append(items, fmt.Sprintf("%03d", n))
+		}
+		fmt.Printf("%s: %d characters are set but not used by the firmware: %s\n", input, len(res.Unused), strings.Join(items, " "))
+	}
+	var missingASCII []string
+	for _, n := range res.MissingASCII {
+		missingASCII = append(missingASCII, string(rune(n)))
+	}
+	total := asciiPrintableLast - asciiPrintableFirst + 1
+	fmt.Printf("%s: printable ASCII coverage %d/%d", input, total-len(missingASCII), total)
+	if len(missingASCII) > 0 {
+		fmt.Printf(", missing %s", strings.Join(missingASCII, " "))
+	}
+	fmt.Println()
+
+	if len(res.Missing) > 0 {
+		return fmt.Errorf("%s is missing %d required characters", input, len(res.Missing))
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseRequiredChars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	symbolsFile := filepath.Join(dir, "symbols.yaml")
+	if err := ioutil.WriteFile(symbolsFile, []byte("SYM_RSSI: 0x01\nSYM_VOLT: 6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	symbols, err := loadSymbolTable(symbolsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		data     string
+		symbols  *symbolTable
+		expected []int
+		err      bool
+	}{
+		{data: "1\n0x10-0x12\n", expected: []int{1, 16, 17, 18}},
+		{data: "# comment\n\n  5 # five\n", expected: []int{5}},
+		{data: "SYM_RSSI\nSYM_VOLT\n2\n", symbols: symbols, expected: []int{1, 6, 2}},
+		{data: "SYM_RSSI\n", err: true},
+		{data: "300\n", err: true},
+	}
+	filename := filepath.Join(dir, "required.txt")
+	for _, tc := range testCases {
+		if err := ioutil.WriteFile(filename, []byte(tc.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		required, err := parseRequiredChars(filename, tc.symbols, 256)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expecting an error parsing %q, got %v", tc.data, required)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error parsing %q: %v", tc.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(required, tc.expected) {
+			t.Errorf("parsing %q: expecting %v, got %v", tc.data, tc.expected, required)
+		}
+	}
+}
+
+func TestCheckFont(t *testing.T) {
+	chars := make(charMap)
+	for ii := asciiPrintableFirst; ii <= asciiPrintableLast; ii++ {
+		if ii != 'A' {
+			chars[ii] = testBoxChar(t, 3, 3, 4, 4, true)
+		}
+	}
+	chars[1] = testBoxChar(t, 3, 3, 4, 4, true)
+	chars[2] = testBoxChar(t, 3, 3, 5, 4, true)
+	res := checkFont(testLintDecoder(t, chars), map[int]bool{1: true, 6: true, 'B': true})
+	if expected := []int{6}; !reflect.DeepEqual(res.Missing, expected) {
+		t.Errorf("expecting missing %v, got %v", expected, res.Missing)
+	}
+	if expected := []int{2}; !reflect.DeepEqual(res.Unused, expected) {
+		t.Errorf("expecting unused %v, got %v", expected, res.Unused)
+	}
+	if expected := []int{'A'}; !reflect.DeepEqual(res.MissingASCII, expected) {
+		t.Errorf("expecting missing ASCII %v, got %v", expected, res.MissingASCII)
+	}
+}
+
+func TestResolveSymbolTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	symbolsFile := filepath.Join(dir, "betaflight-4.4.yaml")
+	if err := ioutil.WriteFile(symbolsFile, []byte("SYM_RSSI: 0x01\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv(firmwareDirEnv, os.Getenv(firmwareDirEnv))
+	os.Setenv(firmwareDirEnv, "")
+
+	testCases := []struct {
+		name string
+		dir  string
+		env  string
+		err  bool
+	}{
+		{name: symbolsFile},
+		{name: "betaflight-4.4", dir: dir},
+		{name: "betaflight-4.4", env: dir},
+		{name: "betaflight-4.4", err: true},
+		{name: "inav-7.0", dir: dir, err: true},
+	}
+	for _, tc := range testCases {
+		os.Setenv(firmwareDirEnv, tc.env)
+		st, err := resolveSymbolTable(tc.name, tc.dir)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expecting an error resolving %q in %q", tc.name, tc.dir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error resolving %q in %q: %v", tc.name, tc.dir, err)
+			continue
+		}
+		if n, found := st.Lookup("SYM_RSSI"); !found || n != 1 {
+			t.Errorf("resolving %q: expecting SYM_RSSI = 1, got %d", tc.name, n)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiam/max7456tool/mcm"
+)
+
+const (
+	defaultSHA256Bytes = 8
+	sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+)
+
+var (
+	// timestampIntTypeRe matches the integer types, used to reject
+	// the ones that can't store a timestamp instead of taking them
+	// as a time layout
+	timestampIntTypeRe = regexp.MustCompile(`^[lb]?[ui](8|16|32|64)$`)
+)
+
+// computedField represents a value in the extra data which can
+// only be calculated once all the characters in the font have
+// been assembled (e.g. a checksum). When parsing, its space
+// is filled with zeroes.
+type computedField struct {
+	// Description used in error messages
+	Name string
+	// Metadata is true if the field is in the metadata, otherwise
+	// it's in the data.
+	Metadata bool
+	Offset   int
+	Size     int
+	// Chars that the value depends on
+	Chars []int
+	// Compute returns the value from the data of the characters in Chars
+	Compute func(data []byte) ([]byte, error)
+}
+
+// parseChecksumField parses crc16, crc32 and sha256 entries. The argument
+// is either a character selection or a map with the chars key. sha256
+// also accepts a bytes key, indicating the number of bytes to keep.
+func parseChecksumField(typ string, v interface{}) (*computedField, error) {
+	var sel string
+	nbytes := 0
+	switch x := v.(type) {
+	case string:
+		sel = x
+	case int:
+		sel = strconv.Itoa(x)
+	case map[interface{}]interface{}:
+		for k, v := range x {
+			switch k {
+			case "chars":
+				sel = fmt.Sprint(v)
+			case "bytes":
+				n, err := toInt64(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s bytes: %v", typ, err)
+				}
+				nbytes = int(n)
+			default:
+				return nil, fmt.Errorf("unknown key %v in %s", k, typ)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("argument to %s must be a character selection or a map, it's %T", typ, v)
+	}
+	if sel == "" {
+		return nil, fmt.Errorf("%s requires a character selection", typ)
+	}
+	chars, err := parseCharSelection(sel, mcm.ExtendedCharNum)
+	if err != nil {
+		return nil, err
+	}
+	f := &computedField{
+		Name:  fmt.Sprintf("%s(%s)", typ, sel),
+		Chars: chars,
+	}
+	switch typ {
+	case "lcrc16", "bcrc16", "lcrc32", "bcrc32":
+		if nbytes != 0 {
+			return nil, fmt.Errorf("%s doesn't accept bytes", typ)
+		}
+		bo := binary.ByteOrder(binary.LittleEndian)
+		if typ[0] == 'b' {
+			bo = binary.BigEndian
+		}
+		crcType := typ[1:]
+		if f.Size, err = crcSize(crcType); err != nil {
+			return nil, err
+		}
+		f.Compute = func(data []byte) ([]byte, error) {
+			return crcBytes(crcType, data, bo)
+		}
+	case "sha256":
+		if nbytes == 0 {
+			nbytes = defaultSHA256Bytes
+		}
+		if nbytes < 1 || nbytes > sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 bytes %d, must be in [1, %d]", nbytes, sha256.Size)
+		}
+		f.Size = nbytes
+		f.Compute = func(data []byte) ([]byte, error) {
+			sum := sha256.Sum256(data)
+			return sum[:nbytes], nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown checksum type %s", typ)
+	}
+	return f, nil
+}
+
+// buildTime returns the time used for timestamps. To make builds
+// reproducible, it can be overridden with $SOURCE_DATE_EPOCH.
+func buildTime() (time.Time, error) {
+	if s := os.Getenv(sourceDateEpochEnv); s != "" {
+		secs, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid $%s %q: %v", sourceDateEpochEnv, s, err)
+		}
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Now().UTC(), nil
+}
+
+// timestampValue returns the value for a timestamp entry in the
+// extra data. The argument is either an integer type (e.g. lu32)
+// to store the Unix time or a Go time layout (e.g. 2006-01-02) to
+// store it formatted as a string. The returned values can be
+// encoded with charBinaryData.addValues.
+func timestampValue(v interface{}) (map[interface{}]interface{}, error) {
+	typ, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("argument to timestamp must be a string, it's %T", v)
+	}
+	t, err := buildTime()
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case "lu32", "bu32", "lu64", "bu64", "li64", "bi64":
+		return map[interface{}]interface{}{typ: int(t.Unix())}, nil
+	}
+	if timestampIntTypeRe.MatchString(typ) {
+		return nil, fmt.Errorf("invalid timestamp type %s, must be lu32, bu32, lu64, bu64, li64 or bi64", typ)
+	}
+	if !hasTimeVerbs(typ) {
+		return nil, fmt.Errorf("timestamp layout %q doesn't contain any time fields, use a Go layout like 2006-01-02", typ)
+	}
+	return map[interface{}]interface{}{"s": t.Format(typ)}, nil
+}
+
+// hasTimeVerbs returns true iff layout contains any element of a
+// Go time layout, by formatting two times that differ in all their
+// fields.
+func hasTimeVerbs(layout string) bool {
+	t1 := time.Date(2006, 1, 2, 15, 4, 5, 123456789, time.UTC)
+	t2 := time.Date(2017, 11, 23, 8, 38, 49, 987654321, time.FixedZone("X", 3600))
+	return t1.Format(layout) != t2.Format(layout)
+}
+
+// defineEntry is the argument of a define entry, which takes its
+// value from the --define flag. It accepts either the name of the
+// definition (stored as a string) or a map with the name, the type,
+// an optional default value and, for strings, an optional size:
+//
+//	metadata:
+//	  - define: VERSION
+//	  - define: {name: REVISION, type: lu16, default: 0}
+//	  - define: {name: TARGET, size: 8}
+type defineEntry struct {
+	Name    string
+	Type    string
+	Default interface{}
+	// Size is the number of bytes used by string defines, padded
+	// with NULs. If zero, the length of the value is used.
+	Size int
+}
+
+func parseDefineEntry(v interface{}) (*defineEntry, error) {
+	e := &defineEntry{Type: "s"}
+	switch x := v.(type) {
+	case string:
+		e.Name = x
+	case map[interface{}]interface{}:
+		for k, v := range x {
+			switch k {
+			case "name":
+				e.Name = fmt.Sprint(v)
+			case "type":
+				e.Type = fmt.Sprint(v)
+			case "default":
+				e.Default = v
+			case "size":
+				n, err := toInt64(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid size: %v", err)
+				}
+				if n < 1 {
+					return nil, fmt.Errorf("invalid size %d", n)
+				}
+				e.Size = int(n)
+			default:
+				return nil, fmt.Errorf("unknown key %v in define", k)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("argument to define must be a string or a map, it's %T", v)
+	}
+	if e.Name == "" {
+		return nil, errors.New("define requires a name")
+	}
+	if e.Size > 0 && e.Type != "s" {
+		return nil, fmt.Errorf("define %s: size is only valid for strings", e.Name)
+	}
+	return e, nil
+}
+
+// defineValue returns the value for a define entry (see defineEntry)
+func defineValue(v interface{}, defines map[string]string) (map[interface{}]interface{}, error) {
+	e, err := parseDefineEntry(v)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if s, found := defines[e.Name]; found {
+		value = s
+		if e.Type != "s" {
+			// Parse numbers, otherwise single digit strings would
+			// be interpreted as characters by toInt64
+			if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+				value = int(i)
+			} else if f, err := strconv.ParseFloat(s, 64); err == nil {
+				value = f
+			}
+		}
+	} else if e.Default != nil {
+		value = e.Default
+	} else {
+		return nil, fmt.Errorf("%s is not defined, use --define %s=value", e.Name, e.Name)
+	}
+	if e.Type == "s" {
+		s := fmt.Sprint(value)
+		if e.Size > 0 {
+			if len(s) > e.Size {
+				return nil, fmt.Errorf("define %s is %d bytes long, maximum is %d", e.Name, len(s), e.Size)
+			}
+			s += strings.Repeat("\x00", e.Size-len(s))
+		}
+		value = s
+	}
+	return map[interface{}]interface{}{e.Type: value}, nil
+}
+
+// parseDefines parses the values of the --define flag, each
+// one of them in the key=value format
+func parseDefines(values []string) (map[string]string, error) {
+	defines := make(map[string]string, len(values))
+	for _, v := range values {
+		p := strings.IndexByte(v, '=')
+		if p <= 0 {
+			return nil, fmt.Errorf("invalid definition %q, must be key=value", v)
+		}
+		defines[v[:p]] = v[p+1:]
+	}
+	return defines, nil
+}
+
+// ResolveComputed calculates all the computed fields in the data set
+// and updates the characters in chars accordingly. Characters are
+// resolved in order. A computed field might depend on characters
+// with other computed fields only if these have already been resolved
+// (i.e. their index is lower).
+func (fs *fontDataSet) ResolveComputed(chars charMap, charNum int) error {
+	var keys []int
+	for k, v := range fs.dataSet {
+		if len(v.Computed) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Ints(keys)
+	pending := make(map[int]bool, len(keys))
+	for _, k := range keys {
+		pending[k] = true
+	}
+	for _, k := range keys {
+		chr := chars[k]
+		if chr == nil {
+			return fmt.Errorf("character %03d with computed fields is missing", k)
+		}
+		data := chr.Data()
+		for _, f := range fs.dataSet[k].Computed {
+			var buf bytes.Buffer
+			for _, n := range f.Chars {
+				if n >= charNum {
+					return fmt.Errorf("%s in character %03d: character %d is out of bounds, font has %d characters", f.Name, k, n, charNum)
+				}
+				if pending[n] {
+					return fmt.Errorf("%s in character %03d depends on character %03d, which has unresolved computed fields", f.Name, k, n)
+				}
+				c := chars[n]
+				if c == nil {
+					c = blankChar()
+				}
+				buf.Write(c.Data())
+			}
+			value, err := f.Compute(buf.Bytes())
+			if err != nil {
+				return fmt.Errorf("%s in character %03d: %v", f.Name, k, err)
+			}
+			offset := f.Offset
+			if f.Metadata {
+				offset += mcm.MinCharBytes
+			}
+			fs.Log.Verbose("setting %s in character %03d to %x", f.Name, k, value)
+			copy(data[offset:offset+f.Size], value)
+		}
+		resolved, err := mcm.NewCharFromData(data)
+		if err != nil {
+			return err
+		}
+		chars[k] = resolved
+		delete(pending, k)
+	}
+	return nil
+}
+
+func blankChar() *mcm.Char {
+	data := make([]byte, mcm.CharBytes)
+	for ii := range data {
+		data[ii] = mcmTransparentByte
+	}
+	chr, _ := mcm.NewCharFromData(data)
+	return chr
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	includeKey = "include"
+	varsKey    = "vars"
+)
+
+// configFile is a config file loaded by generate, with the
+// files it includes
+type configFile struct {
+	Name   string
+	Dir    string
+	Source *yamlFile
+	// Vars contains the variables declared in this file
+	Vars     map[string]string
+	Includes []*configFile
+}
+
+// AllVars returns the variables declared in f and the files it
+// includes. Variables in later includes override the ones in
+// earlier includes and the ones in f override all of them.
+func (f *configFile) AllVars() map[string]string {
+	vars := make(map[string]string)
+	for _, inc := range f.Includes {
+		for k, v := range inc.AllVars() {
+			vars[k] = v
+		}
+	}
+	for k, v := range f.Vars {
+		vars[k] = v
+	}
+	return vars
+}
+
+// configLoader loads a config file for generate, following its
+// includes and expanding the variables in it
+type configLoader struct {
+	// Defines contains the variables set via --define, which
+	// take precedence over the environment and vars
+	Defines map[string]string
+	loading []string
+}
+
+// Lookup returns the value for the variable name, looking first at
+// the defines, then at vars and finally at the environment
+func (l *configLoader) Lookup(name string, vars map[string]string) (string, bool) {
+	if v, found := l.Defines[name]; found {
+		return v, true
+	}
+	if v, found := vars[name]; found {
+		return v, true
+	}
+	return os.LookupEnv(name)
+}
+
+// Expand replaces ${NAME} in s with the value of the variable NAME,
+// see Lookup. $${ is replaced by a literal ${.
+func (l *configLoader) Expand(s string, vars map[string]string) (string, error) {
+	var buf strings.Builder
+	for {
+		idx := strings.Index(s, "${")
+		if idx < 0 {
+			buf.WriteString(s)
+			break
+		}
+		if idx > 0 && s[idx-1] == '$' {
+			// Escaped
+			buf.WriteString(s[:idx-1])
+			buf.WriteString("${")
+			s = s[idx+2:]
+			continue
+		}
+		buf.WriteString(s[:idx])
+		end := strings.IndexByte(s[idx:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable in %q", s)
+		}
+		name := s[idx+2 : idx+end]
+		if !cIdentifierRe.MatchString(name) {
+			return "", fmt.Errorf("invalid variable name %q", name)
+		}
+		v, found := l.Lookup(name, vars)
+		if !found {
+			return "", fmt.Errorf("undefined variable %s, declare it in %s or use --define %s=value", name, varsKey, name)
+		}
+		buf.WriteString(v)
+		s = s[idx+end+1:]
+	}
+	return buf.String(), nil
+}
+
+// Load loads filename and all the files it includes. Variables
+// declared by the files including another one are visible in
+// the paths of its includes.
+func (l *configLoader) Load(filename string, inherited map[string]string) (*configFile, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	for ii, v := range l.loading {
+		if v == abs {
+			cycle := append(append([]string(nil), l.loading[ii:]...), abs)
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	l.loading = append(l.loading, abs)
+	defer func() { l.loading = l.loading[:len(l.loading)-1] }()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %s: %v", filename, err)
+	}
+	source, err := parseYAMLFile(filename, data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file: %v", err)
+	}
+	f := &configFile{
+		Name:   filename,
+		Dir:    filepath.Dir(filename),
+		Source: source,
+		Vars:   make(map[string]string),
+	}
+	var top struct {
+		Include []string          `yaml:"include"`
+		Vars    map[string]string `yaml:"vars"`
+	}
+	if node := source.Value(includeKey); node != nil {
+		if err := node.Decode(&top.Include); err != nil {
+			return nil, source.Wrap(fmt.Errorf("%s must be a list of files: %v", includeKey, err), includeKey)
+		}
+	}
+	if node := source.Value(varsKey); node != nil {
+		if err := node.Decode(&top.Vars); err != nil {
+			return nil, source.Wrap(fmt.Errorf("%s must be a map of strings: %v", varsKey, err), varsKey)
+		}
+	}
+	visible := make(map[string]string)
+	for k, v := range top.Vars {
+		if !cIdentifierRe.MatchString(k) {
+			return nil, source.Wrap(fmt.Errorf("invalid variable name %q", k), varsKey, k)
+		}
+		f.Vars[k] = v
+		visible[k] = v
+	}
+	// Variables from the including files take precedence
+	for k, v := range inherited {
+		visible[k] = v
+	}
+	for ii, v := range top.Include {
+		p, err := l.Expand(v, visible)
+		if err != nil {
+			return nil, source.Wrap(err, includeKey, ii)
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(f.Dir, p)
+		}
+		inc, err := l.Load(p, visible)
+		if err != nil {
+			return nil, source.Wrap(err, includeKey, ii)
+		}
+		f.Includes = append(f.Includes, inc)
+	}
+	return f, nil
+}
+
+// Decode expands the variables in f and its includes, decodes them
+// and merges them into c, with f overriding its includes.
+func (l *configLoader) Decode(f *configFile, vars map[string]string, c *generateConfig) error {
+	for _, inc := range f.Includes {
+		if err := l.Decode(inc, vars, c); err != nil {
+			return err
+		}
+	}
+	root := f.Source.Root
+	if root == nil {
+		// Empty file
+		return nil
+	}
+	if err := l.expandNode(f.Source, root, vars, nil); err != nil {
+		return err
+	}
+	var fc generateConfig
+	if err := f.Source.CheckKeys(&fc); err != nil {
+		return fmt.Errorf("error parsing config file: %v", err)
+	}
+	if err := root.Decode(&fc); err != nil {
+		return fmt.Errorf("error parsing config file %s: %v", f.Name, err)
+	}
+	c.merge(&fc, f)
+	return nil
+}
+
+// expandNode expands the variables in all the scalar values under
+// node, except in the includes and vars, which are handled by Load
+func (l *configLoader) expandNode(source *yamlFile, node *yaml.Node, vars map[string]string, path []interface{}) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for ii := 0; ii+1 < len(node.Content); ii += 2 {
+			key := node.Content[ii].Value
+			if len(path) == 0 && (key == includeKey || key == varsKey) {
+				continue
+			}
+			childPath := append(append([]interface{}(nil), path...), key)
+			if err := l.expandNode(source, node.Content[ii+1], vars, childPath); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for ii, item := range node.Content {
+			childPath := append(append([]interface{}(nil), path...), ii)
+			if err := l.expandNode(source, item, vars, childPath); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			break
+		}
+		v, err := l.Expand(node.Value, vars)
+		if err != nil {
+			return source.Wrap(err, path...)
+		}
+		node.Value = v
+		if node.Style == 0 {
+			// Let plain values be resolved again, so
+			// e.g. ${PREVIEWS} might become a bool
+			node.Tag = ""
+		}
+	}
+	return nil
+}
+
+// merge adds the config decoded from f to c. Fonts with the same
+// source directory replace the previous ones, extra data files are appended
+// and the rest of the top level keys replace the previous values
+// if they're present in f.
+func (c *generateConfig) merge(fc *generateConfig, f *configFile) {
+	if f.Source.Value("previews") != nil {
+		c.Previews = fc.Previews
+	}
+	if f.Source.Value("default") != nil {
+		c.DefaultFont = fc.DefaultFont
+		c.defaultSource = f.Source
+	}
+	if f.Source.Value("outputs") != nil {
+		c.Outputs = fc.Outputs
+		c.outputsSource = f.Source
+	}
+	for ii, v := range fc.ExtraData {
+		c.extraFiles = append(c.extraFiles, &configExtraFile{
+			Path:   filepath.Join(f.Dir, v),
+			source: f.Source,
+			index:  ii,
+		})
+	}
+	for ii, v := range fc.Fonts {
+		v.dir = f.Dir
+		v.source = f.Source
+		v.index = ii
+		replaced := false
+		for jj, prev := range c.Fonts {
+			if filepath.Join(prev.dir, prev.Source) == filepath.Join(v.dir, v.Source) {
+				logVerbose("font %q from %s overrides the one from %s", v.Source, f.Name, prev.source.Name)
+				c.Fonts[jj] = v
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			c.Fonts = append(c.Fonts, v)
+		}
+	}
+}
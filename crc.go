@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	crcTypeCRC16 = "crc16"
+	crcTypeCRC32 = "crc32"
+)
+
+// crc16 returns the CRC-16/CCITT-FALSE checksum (polynomial 0x1021,
+// initial value 0xffff) of data.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for ii := 0; ii < 8; ii++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// crcSize returns the size in bytes of the given CRC type
+func crcSize(typ string) (int, error) {
+	switch typ {
+	case crcTypeCRC16:
+		return 2, nil
+	case crcTypeCRC32:
+		return 4, nil
+	}
+	return 0, fmt.Errorf("invalid CRC type %q, must be %s or %s", typ, crcTypeCRC16, crcTypeCRC32)
+}
+
+// crcBytes returns the CRC of the given type for data, encoded
+// with the given byte order.
+func crcBytes(typ string, data []byte, bo binary.ByteOrder) ([]byte, error) {
+	switch typ {
+	case crcTypeCRC16:
+		b := make([]byte, 2)
+		bo.PutUint16(b, crc16(data))
+		return b, nil
+	case crcTypeCRC32:
+		b := make([]byte, 4)
+		bo.PutUint32(b, crc32.ChecksumIEEE(data))
+		return b, nil
+	}
+	_, err := crcSize(typ)
+	return nil, err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// mergeKey is used to declare the merge mode, either at the top
+	// level of an extra data file or inside a character
+	mergeKey = "merge"
+
+	// mergeAppend appends the data to any previous data for the
+	// same character. This is the default.
+	mergeAppend = "append"
+	// mergeReplace discards any previous data for the same character
+	mergeReplace = "replace"
+	// mergeError rejects characters which already have data
+	mergeError = "error"
+)
+
+func parseMergeMode(v interface{}) (string, error) {
+	s, _ := v.(string)
+	switch s {
+	case mergeAppend, mergeReplace, mergeError:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid %s mode %v, must be %s, %s or %s", mergeKey, v, mergeAppend, mergeReplace, mergeError)
+}
+
+// dataSource records the file and line that produced a range of
+// bytes in the extra data of a character
+type dataSource struct {
+	File     string
+	Line     int
+	Metadata bool
+	Offset   int
+	Size     int
+}
+
+func (s *dataSource) Location() string {
+	if s.Line > 0 {
+		return fmt.Sprintf("%s:%d", s.File, s.Line)
+	}
+	return s.File
+}
+
+func (s *dataSource) String() string {
+	section := "data"
+	if s.Metadata {
+		section = "metadata"
+	}
+	return fmt.Sprintf("%s [%d, %d) from %s", section, s.Offset, s.Offset+s.Size, s.Location())
+}
+
+// Files returns the files that contributed to c, without duplicates
+func (c *charBinaryData) Files() []string {
+	seen := make(map[string]bool)
+	var files []string
+	for _, s := range c.Sources {
+		if !seen[s.File] {
+			seen[s.File] = true
+			files = append(files, s.File)
+		}
+	}
+	return files
+}
+
+// merge prepares the data for character n before adding the data from
+// filename to it, according to the given merge mode. It returns the
+// charBinaryData where the new data should be added.
+func (fs *fontDataSet) merge(n int, mode string, filename string) (*charBinaryData, error) {
+	chr := fs.dataSet[n]
+	if chr == nil {
+		chr = newCharBinaryData()
+		fs.dataSet[n] = chr
+		return chr, nil
+	}
+	prev := strings.Join(chr.Files(), ", ")
+	switch mode {
+	case mergeError:
+		return nil, fmt.Errorf("character %03d already has extra data from %s", n, prev)
+	case mergeReplace:
+		if start := chr.Payload; start >= 0 {
+			// Remove the whole payload, otherwise the rest of
+			// its characters would be left orphaned
+			var span []int
+			for k, v := range fs.dataSet {
+				if v.Payload == start {
+					span = append(span, k)
+				}
+			}
+			sort.Ints(span)
+			for _, k := range span {
+				delete(fs.dataSet, k)
+			}
+			fs.Log.Verbose("replacing payload in characters %03d-%03d from %s with extra data for character %03d from %s",
+				span[0], span[len(span)-1], prev, n, filename)
+		} else {
+			fs.Log.Verbose("replacing extra data for character %03d from %s with %s", n, prev, filename)
+		}
+		chr = newCharBinaryData()
+		fs.dataSet[n] = chr
+	default:
+		fs.Log.Verbose("appending extra data for character %03d from %s to %s", n, filename, prev)
+	}
+	return chr, nil
+}
+
+// WriteReport writes the source of every byte range in the
+// extra data, sorted by character.
+func (fs *fontDataSet) WriteReport(w io.Writer) error {
+	var keys []int
+	for k := range fs.dataSet {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		for _, s := range fs.dataSet[k].Sources {
+			if _, err := fmt.Fprintf(w, "%03d %s\n", k, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dataReportMu serializes writes to the data report, since
+// fonts might be generated in parallel
+var dataReportMu sync.Mutex
+
+// writeDataReport writes the report for the extra data in fontData
+// to the writer in opts, if any. The report for each font is
+// written at once, so reports from several fonts don't interleave.
+func writeDataReport(opts *buildOptions, output string, fontData *fontDataSet) error {
+	if opts.DataReport == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s\n", output)
+	if err := fontData.WriteReport(&buf); err != nil {
+		return err
+	}
+	dataReportMu.Lock()
+	defer dataReportMu.Unlock()
+	_, err := opts.DataReport.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiam/max7456tool/mcm"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// dataDecoder decodes the extra data stored in a font using a
+// schema. Schemas use the same format as extra data files, so a
+// file used to build a font can be used to decode it. Values in
+// the schema are ignored, except when they're needed to determine
+// the size of an entry (e.g. the length of a string). In that case,
+// the length of the value in the schema is used. Alternatively,
+// an integer can be used as the size (e.g. s: 4 or hex: 10).
+type dataDecoder struct {
+	Chars []*mcm.Char
+	// Dir is used to resolve relative paths in file entries
+	Dir string
+	// Types contains the struct types declared in the schema
+	Types map[string]*structType
+}
+
+func schemaLength(typ string, v interface{}) (int, error) {
+	switch x := v.(type) {
+	case int:
+		return x, nil
+	case string:
+		switch typ {
+		case "hex":
+			x = strings.NewReplacer(" ", "", ":", "", "\n", "").Replace(x)
+			return len(x) / 2, nil
+		case "b64":
+			x = strings.NewReplacer(" ", "", "\n", "").Replace(x)
+			enc := base64.StdEncoding
+			if !strings.HasSuffix(x, "=") {
+				enc = base64.RawStdEncoding
+			}
+			return enc.DecodedLen(len(x)), nil
+		}
+		return len(x), nil
+	}
+	return 0, fmt.Errorf("can't determine the length of %s from %v (%T)", typ, v, v)
+}
+
+// decodeInteger decodes a fixed size integer or float type from data,
+// which must have exactly entryTypes[typ].Size bytes.
+func decodeInteger(typ string, data []byte) interface{} {
+	if typ == "u8" {
+		return int(data[0])
+	}
+	if typ == "i8" {
+		return int(int8(data[0]))
+	}
+	bo := binary.ByteOrder(binary.LittleEndian)
+	if typ[0] == 'b' {
+		bo = binary.BigEndian
+	}
+	switch typ[1:] {
+	case "u16":
+		return int(bo.Uint16(data))
+	case "i16":
+		return int(int16(bo.Uint16(data)))
+	case "u32":
+		return int64(bo.Uint32(data))
+	case "i32":
+		return int(int32(bo.Uint32(data)))
+	case "u64":
+		return bo.Uint64(data)
+	case "i64":
+		return int64(bo.Uint64(data))
+	case "f32":
+		// Format with float32 precision, so 1.2 isn't
+		// decoded as 1.2000000476837158
+		f := math.Float32frombits(bo.Uint32(data))
+		v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+		return v
+	case "f64":
+		return math.Float64frombits(bo.Uint64(data))
+	}
+	panic(fmt.Errorf("unknown integer type %s", typ))
+}
+
+func decodeFixedPoint(t *fixedPointType, data []byte) float64 {
+	var buf [8]byte
+	size := t.Size()
+	var raw uint64
+	if t.ByteOrder == binary.ByteOrder(binary.LittleEndian) {
+		copy(buf[:], data)
+		raw = binary.LittleEndian.Uint64(buf[:])
+	} else {
+		copy(buf[8-size:], data)
+		raw = binary.BigEndian.Uint64(buf[:])
+	}
+	total := t.IntBits + t.FracBits
+	if t.Signed && total < 64 && raw&(1<<(total-1)) != 0 {
+		// Sign extend
+		raw |= ^uint64(0) << total
+	}
+	if t.Signed {
+		return math.Ldexp(float64(int64(raw)), -int(t.FracBits))
+	}
+	return math.Ldexp(float64(raw), -int(t.FracBits))
+}
+
+func decodeColors(v interface{}, data byte) (string, error) {
+	count := 4
+	switch x := v.(type) {
+	case int:
+		count = x
+	case string:
+		count = len(strings.Split(x, ","))
+	}
+	if count < 1 || count > 4 {
+		return "", fmt.Errorf("invalid number of colors %d", count)
+	}
+	var colors []string
+	for ii := 0; ii < count; ii++ {
+		var name string
+		switch mcm.Pixel((data >> uint(ii*2)) & 0x03) {
+		case mcm.PixelBlack:
+			name = "BLACK"
+		case mcm.PixelWhite:
+			name = "WHITE"
+		case mcm.PixelTransparent:
+			name = "TRANSPARENT"
+		case mcm.PixelGray:
+			name = "GRAY"
+		}
+		colors = append(colors, name)
+	}
+	return strings.Join(colors, ","), nil
+}
+
+func decodeBitfield(v interface{}, data []byte) (interface{}, int, error) {
+	bf, err := parseBitfieldSchema(v)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := uint(0)
+	for _, f := range bf.Fields {
+		total += f.Width
+	}
+	if total%8 != 0 {
+		return nil, 0, fmt.Errorf("bits fields add up to %d bits, must be a multiple of 8", total)
+	}
+	size := int(total / 8)
+	if size > len(data) {
+		return nil, 0, fmt.Errorf("bits require %d bytes, only %d available", size, len(data))
+	}
+	fm, _ := v.(map[interface{}]interface{})
+	schemaFields, _ := fm["fields"].([]interface{})
+	var fields []interface{}
+	pos := uint(0)
+	for ii, f := range bf.Fields {
+		var value uint64
+		for jj := uint(0); jj < f.Width; jj++ {
+			var bit uint64
+			if bf.Order == bitOrderMSB {
+				bit = uint64(data[pos/8]>>(7-pos%8)) & 1
+				value |= bit << (f.Width - 1 - jj)
+			} else {
+				bit = uint64(data[pos/8]>>(pos%8)) & 1
+				value |= bit << jj
+			}
+			pos++
+		}
+		field := yamlMap{}
+		if f.Name != "" {
+			field = append(field, yamlMapItem{Key: "name", Value: f.Name})
+		}
+		field = append(field, yamlMapItem{Key: "width", Value: int(f.Width)})
+		var fv interface{} = value
+		// Keep booleans as booleans
+		if sm, ok := schemaFields[ii].(map[interface{}]interface{}); ok {
+			if _, isBool := sm["value"].(bool); isBool {
+				fv = value != 0
+			}
+		}
+		field = append(field, yamlMapItem{Key: "value", Value: fv})
+		fields = append(fields, field)
+	}
+	result := yamlMap{}
+	if _, found := fm["order"]; found {
+		result = append(result, yamlMapItem{Key: "order", Value: bf.Order})
+	}
+	result = append(result, yamlMapItem{Key: "fields", Value: fields})
+	return result, size, nil
+}
+
+// parseBitfieldSchema parses a bits entry ignoring its values
+func parseBitfieldSchema(v interface{}) (*bitfield, error) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("argument to bits must be a map, it's %T", v)
+	}
+	schema := make(map[interface{}]interface{}, len(m))
+	for k, v := range m {
+		schema[k] = v
+	}
+	if fields, ok := m["fields"].([]interface{}); ok {
+		var zeroed []interface{}
+		for _, f := range fields {
+			fm, ok := f.(map[interface{}]interface{})
+			if !ok {
+				return nil, fmt.Errorf("bits field must be a map, it's %T", f)
+			}
+			zf := make(map[interface{}]interface{}, len(fm))
+			for k, v := range fm {
+				zf[k] = v
+			}
+			zf["value"] = 0
+			zeroed = append(zeroed, zf)
+		}
+		schema["fields"] = zeroed
+	}
+	return parseBitfield(schema)
+}
+
+// checksumData returns the data used to calculate the checksums
+// in computed fields.
+func (d *dataDecoder) checksumData(f *computedField) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, n := range f.Chars {
+		if n >= len(d.Chars) {
+			return nil, fmt.Errorf("%s: character %d is out of bounds", f.Name, n)
+		}
+		buf.Write(d.Chars[n].Data())
+	}
+	return buf.Bytes(), nil
+}
+
+// needBytes returns an error if an entry of type typ which
+// requires n bytes can't be decoded from data
+func needBytes(typ string, n int, data []byte) error {
+	if n > len(data) {
+		return fmt.Errorf("%s requires %d bytes, only %d available", typ, n, len(data))
+	}
+	return nil
+}
+
+func decodedEntry(typ string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{typ: value}
+}
+
+func decodeIntegerEntry(d *dataDecoder, typ string, v interface{}, data []byte) (interface{}, int, error) {
+	size := entryTypes[typ].Size
+	if err := needBytes(typ, size, data); err != nil {
+		return nil, 0, err
+	}
+	return decodedEntry(typ, decodeInteger(typ, data[:size])), size, nil
+}
+
+func decodeBytesEntry(d *dataDecoder, typ string, v interface{}, data []byte) (interface{}, int, error) {
+	n, err := schemaLength(typ, v)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := needBytes(typ, n, data); err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case "s":
+		return decodedEntry(typ, string(data[:n])), n, nil
+	case "hex":
+		return decodedEntry(typ, hex.EncodeToString(data[:n])), n, nil
+	}
+	return decodedEntry(typ, base64.StdEncoding.EncodeToString(data[:n])), n, nil
+}
+
+func decodeFileEntry(d *dataDecoder, typ string, v interface{}, data []byte) (interface{}, int, error) {
+	filename, ok := v.(string)
+	if !ok {
+		return nil, 0, fmt.Errorf("argument to file must be a string, it's %T", v)
+	}
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(d.Dir, filename)
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading data file: %v", err)
+	}
+	n := len(contents)
+	if err := needBytes(typ, n, data); err != nil {
+		return nil, 0, err
+	}
+	if bytes.Equal(contents, data[:n]) {
+		return decodedEntry(typ, v), n, nil
+	}
+	logVerbose("data doesn't match the contents of %s", filename)
+	return decodedEntry("hex", hex.EncodeToString(data[:n])), n, nil
+}
+
+func decodeColorsEntry(d *dataDecoder, typ string, v interface{}, data []byte) (interface{}, int, error) {
+	if err := needBytes(typ, 1, data); err != nil {
+		return nil, 0, err
+	}
+	colors, err := decodeColors(v, data[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodedEntry(typ, colors), 1, nil
+}
+
+func decodeBitfieldEntry(d *dataDecoder, typ string, v interface{}, data []byte) (interface{}, int, error) {
+	value, n, err := decodeBitfield(v, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodedEntry(typ, value), n, nil
+}
+
+func decodeChecksumEntry(d *dataDecoder, typ string, v interface{}, data []byte) (interface{}, int, error) {
+	f, err := parseChecksumField(typ, v)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := needBytes(typ, f.Size, data); err != nil {
+		return nil, 0, err
+	}
+	cd, err := d.checksumData(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	expected, err := f.Compute(cd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(expected, data[:f.Size]) {
+		logVerbose("%s doesn't match, stored %x, computed %x", f.Name, data[:f.Size], expected)
+		return decodedEntry("hex", hex.EncodeToString(data[:f.Size])), f.Size, nil
+	}
+	return decodedEntry(typ, v), f.Size, nil
+}
+
+func decodeTimestampEntry(d *dataDecoder, typ string, v interface{}, data []byte) (interface{}, int, error) {
+	layout, ok := v.(string)
+	if !ok {
+		return nil, 0, fmt.Errorf("argument to timestamp must be a string, it's %T", v)
+	}
+	value, err := timestampValue(layout)
+	if err != nil {
+		return nil, 0, err
+	}
+	for k, vv := range value {
+		raw, n, err := d.decodeEntry(fmt.Sprint(k), vv, data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if k == "s" {
+			// Formatted times might have a different length, only
+			// emit the timestamp if the stored bytes can be parsed
+			// with the layout
+			if _, err := time.Parse(layout, string(data[:n])); err != nil {
+				logVerbose("%q doesn't match the timestamp layout %q", data[:n], layout)
+				return raw, n, nil
+			}
+		}
+		return decodedEntry(typ, v), n, nil
+	}
+	return nil, 0, fmt.Errorf("invalid timestamp %v", v)
+}
+
+func decodeDefineEntry(d *dataDecoder, typ string, v interface{}, data []byte) (interface{}, int, error) {
+	e, err := parseDefineEntry(v)
+	if err != nil {
+		return nil, 0, err
+	}
+	var value interface{}
+	var n int
+	if e.Type == "s" && (e.Size > 0 || e.Default == nil) {
+		// Strings use their size or, without a size nor a default
+		// value to take the length from, the remaining bytes up
+		// to the first NUL
+		n = e.Size
+		if n == 0 {
+			if n = bytes.IndexByte(data, 0); n < 0 {
+				n = len(data)
+			}
+		}
+		if err := needBytes(typ, n, data); err != nil {
+			return nil, 0, err
+		}
+		value = strings.TrimRight(string(data[:n]), "\x00")
+	} else {
+		schema := e.Default
+		if schema == nil {
+			// No default value, use a zero value for the type
+			schema = 0
+		}
+		decoded, dn, err := d.decodeEntry(e.Type, schema, data)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, x := range decoded.(map[string]interface{}) {
+			value = x
+		}
+		n = dn
+	}
+	result := yamlMap{
+		{Key: "name", Value: e.Name},
+		{Key: "type", Value: e.Type},
+	}
+	if e.Size > 0 {
+		result = append(result, yamlMapItem{Key: "size", Value: e.Size})
+	}
+	result = append(result, yamlMapItem{Key: "default", Value: value})
+	return decodedEntry(typ, result), n, nil
+}
+
+// decodeEntry decodes a single entry of type typ at the start of data,
+// returning the decoded entry and the number of bytes used.
+func (d *dataDecoder) decodeEntry(typ string, v interface{}, data []byte) (interface{}, int, error) {
+	if et := entryTypes[typ]; et != nil {
+		return et.Decode(d, typ, v, data)
+	}
+	if st := d.Types[typ]; st != nil {
+		fields, n, err := d.decodeStruct(st, data)
+		if err != nil {
+			return nil, 0, err
+		}
+		return decodedEntry(typ, fields), n, nil
+	}
+	if fp, err := parseFixedPointType(typ); err != nil {
+		return nil, 0, err
+	} else if fp != nil {
+		if err := needBytes(typ, fp.Size(), data); err != nil {
+			return nil, 0, err
+		}
+		return decodedEntry(typ, decodeFixedPoint(fp, data[:fp.Size()])), fp.Size(), nil
+	}
+	return nil, 0, fmt.Errorf("can't decode value with key %q", typ)
+}
+
+// decodeValues decodes the entries in schema from data, returning
+// the decoded entries and the number of bytes used.
+func (d *dataDecoder) decodeValues(schema interface{}, data []byte) ([]interface{}, int, error) {
+	entries, ok := schema.([]interface{})
+	if !ok {
+		return nil, 0, fmt.Errorf("schema is not a list, it's %T", schema)
+	}
+	var values []interface{}
+	pos := 0
+	for ii, e := range entries {
+		em, ok := e.(map[interface{}]interface{})
+		if !ok || len(em) != 1 {
+			return nil, 0, fmt.Errorf("entry %d must be a map with a single key", ii+1)
+		}
+		for k, v := range em {
+			value, n, err := d.decodeEntry(fmt.Sprint(k), v, data[pos:])
+			if err != nil {
+				return nil, 0, fmt.Errorf("entry %d: %v", ii+1, err)
+			}
+			values = append(values, value)
+			pos += n
+		}
+	}
+	return values, pos, nil
+}
+
+// decodePayloadSchema decodes a payload starting at character n
+func (d *dataDecoder) decodePayloadSchema(n int, v interface{}) (interface{}, error) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("payload must be a map, it's %T", v)
+	}
+	opts := &payloadOptions{}
+	if b, ok := m["length"].(bool); ok {
+		opts.Length = b
+	}
+	if s, ok := m["crc"].(string); ok {
+		opts.CRC = s
+	}
+	count := 0
+	if !opts.Length {
+		// Determine the size from the schema
+		p, err := parsePayload(m, &extraDataContext{Dir: d.Dir, Types: d.Types})
+		if err != nil {
+			return nil, err
+		}
+		chunks, err := p.Chunks()
+		if err != nil {
+			return nil, err
+		}
+		count = len(chunks)
+	}
+	data, err := decodePayload(d.Chars, n, count, opts)
+	if err != nil {
+		return nil, err
+	}
+	values, _, err := d.decodeValues(m["data"], data)
+	if err != nil {
+		return nil, err
+	}
+	result := yamlMap{}
+	if opts.Length {
+		result = append(result, yamlMapItem{Key: "length", Value: true})
+	}
+	if opts.CRC != "" {
+		result = append(result, yamlMapItem{Key: "crc", Value: opts.CRC})
+	}
+	result = append(result, yamlMapItem{Key: "data", Value: values})
+	return yamlMap{{Key: "payload", Value: result}}, nil
+}
+
+// Decode decodes the character n using its schema
+func (d *dataDecoder) Decode(n int, schema interface{}) (interface{}, error) {
+	if n < 0 || n >= len(d.Chars) {
+		return nil, fmt.Errorf("character %d is out of bounds, font has %d characters", n, len(d.Chars))
+	}
+	m, ok := schema.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema for character %d is not a map, it's %T", n, schema)
+	}
+	if p := m["payload"]; p != nil {
+		return d.decodePayloadSchema(n, p)
+	}
+	data := d.Chars[n].Data()
+	result := yamlMap{}
+	if m["pixels"] != nil {
+		result = append(result, yamlMapItem{Key: "pixels", Value: formatPixelArt(d.Chars[n])})
+	}
+	if s := m["data"]; s != nil {
+		values, _, err := d.decodeValues(s, data)
+		if err != nil {
+			return nil, fmt.Errorf("character %d data: %v", n, err)
+		}
+		result = append(result, yamlMapItem{Key: "data", Value: values})
+	}
+	if s := m["metadata"]; s != nil {
+		values, _, err := d.decodeValues(s, data[mcm.MinCharBytes:])
+		if err != nil {
+			return nil, fmt.Errorf("character %d metadata: %v", n, err)
+		}
+		result = append(result, yamlMapItem{Key: "metadata", Value: values})
+	}
+	return result, nil
+}
+
+// dumpData decodes all the characters in the schema file, returning
+// them in the same format used by extra data files.
+func dumpData(chars []*mcm.Char, schemaFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(schemaFile)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing schema %s: %v", schemaFile, err)
+	}
+	raw, err := yamlMapValue(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing schema %s: %v", schemaFile, err)
+	}
+	ef, err := splitExtraData(raw, filepath.Dir(schemaFile), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing schema %s: %v", schemaFile, err)
+	}
+	d := &dataDecoder{
+		Chars: chars,
+		Dir:   filepath.Dir(schemaFile),
+		Types: ef.Types,
+	}
+	var keys []int
+	for k := range ef.Chars {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	var result yamlMap
+	if len(ef.Types) > 0 {
+		// Include the types, so the output can be used
+		// as extra data
+		result = append(result, yamlMapItem{Key: typesKey, Value: raw[typesKey]})
+	}
+	for _, k := range keys {
+		v, err := d.Decode(k, ef.Chars[k])
+		if err != nil {
+			return nil, fmt.Errorf("error decoding character %d with schema %s: %v", k, schemaFile, err)
+		}
+		result = append(result, yamlMapItem{Key: k, Value: v})
+	}
+	return encodeYAML(result)
+}
+
+func dumpDataAction(ctx *cli.Context) error {
+	if ctx.NArg() < 2 || ctx.NArg() > 3 {
+		return errors.New("dump-data requires 2 or 3 arguments, see help dump-data")
+	}
+	dec, err := decodeMCMFile(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	data, err := dumpData(decoderChars(dec), ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	if ctx.NArg() == 2 {
+		_, err := fmt.Print(string(data))
+		return err
+	}
+	return writeOutputFile(ctx.Args().Get(2), data)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fiam/max7456tool/mcm"
+)
+
+const testDumpDataSchema = `
+types:
+  offset:
+    - s: 'o'
+    - field: {name: x, type: i8}
+    - field: {name: y, type: i8, default: 0}
+  named:
+    - field: {name: name, type: s, size: 6}
+    - field: {name: pos, type: offset}
+    - lcrc16: 10
+14:
+  pixels: |
+    ............
+    ....XXXX....
+    ...X####X...
+    ...X#gg#X...
+    ...X####X...
+    ....XXXX....
+    ............
+    ............
+    ............
+    ............
+    ............
+    ............
+    ............
+    ............
+    ............
+    ............
+    ............
+    ............
+  metadata:
+    - offset: {x: 13, y: -3}
+15:
+  data:
+    - named: {name: BATT, pos: {x: 1}}
+10:
+  metadata:
+    - s: 'k'
+    - lf32: 1.25
+    - bq8.8: -0.5
+    - luq4.4: 2.5
+    - c: WHITE,BLACK
+11:
+  metadata:
+    - bits:
+        order: msb
+        fields:
+          - {name: visible, width: 1, value: true}
+          - {name: mode, width: 7, value: 5}
+    - hex: 'de:ad'
+    - b64: AQID
+12:
+  data:
+    - s: 'INAV'
+    - li16: -300
+    - bu64: 1234567890123
+    - file: blob.bin
+    - define: {name: REV, type: lu16, default: 0}
+13:
+  data:
+    - lcrc32: 10-12
+    - sha256: {chars: 10-12, bytes: 4}
+20:
+  payload:
+    length: true
+    crc: crc16
+    data:
+      - s: 'A string long enough to span several characters, which is the point of a payload'
+      - u8: 7
+`
+
+func testBuildDataChars(t *testing.T, filename string) []*mcm.Char {
+	return testBuildDataCharsDefines(t, filename, map[string]string{"REV": "42"})
+}
+
+func testBuildDataCharsDefines(t *testing.T, filename string, defines map[string]string) []*mcm.Char {
+	fs := newFontDataSet()
+	fs.Defines = defines
+	if err := fs.ParseFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	chars := make(charMap)
+	for k, v := range fs.Values() {
+		chr, err := v.Char()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chars[k] = chr
+	}
+	if err := fs.ResolveComputed(chars, mcm.CharNum); err != nil {
+		t.Fatal(err)
+	}
+	result := make([]*mcm.Char, mcm.CharNum)
+	for ii := range result {
+		if chr := chars[ii]; chr != nil {
+			result[ii] = chr
+		} else {
+			result[ii] = blankChar()
+		}
+	}
+	return result
+}
+
+func TestDumpDataRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blob, err := ioutil.ReadFile(filepath.Join("_testdata", "blob.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "blob.bin"), blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+	schema := filepath.Join(dir, "schema.yaml")
+	if err := ioutil.WriteFile(schema, []byte(testDumpDataSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chars := testBuildDataChars(t, schema)
+	dumped, err := dumpData(chars, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "dumped.yaml")
+	if err := ioutil.WriteFile(output, dumped, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := testBuildDataChars(t, output)
+	for ii := range chars {
+		if !bytes.Equal(chars[ii].Data(), rebuilt[ii].Data()) {
+			t.Errorf("character %d differs after round trip:\n%x\n%x\ndumped:\n%s", ii, chars[ii].Data(), rebuilt[ii].Data(), dumped)
+		}
+	}
+
+	// Modify a character covered by the checksums, they should be
+	// dumped as hex
+	chars[10] = blankChar()
+	dumped, err = dumpData(chars, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(dumped, []byte("hex:")) || bytes.Contains(dumped, []byte("lcrc32")) {
+		t.Errorf("expecting mismatched checksums to be dumped as hex, got:\n%s", dumped)
+	}
+}
+
+func TestDumpDataTimestamp(t *testing.T) {
+	defer os.Setenv(sourceDateEpochEnv, os.Getenv(sourceDateEpochEnv))
+	os.Setenv(sourceDateEpochEnv, "1600000000")
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	schema := filepath.Join(dir, "schema.yaml")
+	if err := ioutil.WriteFile(schema, []byte("10:\n  data:\n    - timestamp: lu32\n    - timestamp: '2006-01-02'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chars := testBuildDataChars(t, schema)
+	dumped, err := dumpData(chars, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(dumped, []byte("timestamp: lu32")) || !bytes.Contains(dumped, []byte(`timestamp: "2006-01-02"`)) {
+		t.Errorf("expecting timestamps to be dumped as such, got:\n%s", dumped)
+	}
+	output := filepath.Join(dir, "dumped.yaml")
+	if err := ioutil.WriteFile(output, dumped, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt := testBuildDataChars(t, output); !rebuilt[10].Equal(chars[10]) {
+		t.Errorf("character differs after round trip:\n%x\n%x", chars[10].Data(), rebuilt[10].Data())
+	}
+
+	// Data which doesn't match the layout is dumped as is
+	other := filepath.Join(dir, "other.yaml")
+	if err := ioutil.WriteFile(other, []byte("10:\n  data:\n    - lu32: 0\n    - s: 'not a date'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dumped, err = dumpData(testBuildDataChars(t, other), schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(dumped, []byte("s: not a date")) {
+		t.Errorf("expecting the string to be dumped as is, got:\n%s", dumped)
+	}
+}
+
+func TestDumpDataStringDefines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	schema := filepath.Join(dir, "schema.yaml")
+	const data = `
+10:
+  data:
+    - define: {name: TARGET, size: 8}
+    - u8: 7
+  metadata:
+    - define: VERSION
+`
+	if err := ioutil.WriteFile(schema, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chars := testBuildDataCharsDefines(t, schema, map[string]string{"TARGET": "MATEKF4", "VERSION": "4.4.1"})
+	dumped, err := dumpData(chars, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"name: TARGET", "default: MATEKF4", "size: 8", "u8: 7", "name: VERSION", "default: 4.4.1"} {
+		if !bytes.Contains(dumped, []byte(s)) {
+			t.Errorf("expecting %q in the dumped data, got:\n%s", s, dumped)
+		}
+	}
+	// The dumped defaults are used when rebuilding without defines
+	output := filepath.Join(dir, "dumped.yaml")
+	if err := ioutil.WriteFile(output, dumped, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt := testBuildDataCharsDefines(t, output, nil); !rebuilt[10].Equal(chars[10]) {
+		t.Errorf("character differs after round trip:\n%x\n%x\ndumped:\n%s", chars[10].Data(), rebuilt[10].Data(), dumped)
+	}
+}
+
+func TestEntryTypesIntegers(t *testing.T) {
+	// Encoding and decoding fixed size types use the same table
+	for typ, et := range entryTypes {
+		if et.Size == 0 || typ == "c" {
+			continue
+		}
+		value := -100
+		if strings.Contains(typ, "u") {
+			value = 100
+		}
+		c, err := testCharBinaryData(t, fmt.Sprintf("data: [{%s: %d}]", typ, value))
+		if err != nil {
+			t.Errorf("%s: error encoding: %v", typ, err)
+			continue
+		}
+		if len(c.Data) != et.Size {
+			t.Errorf("%s: expecting %d bytes, got %d", typ, et.Size, len(c.Data))
+			continue
+		}
+		decoded, n, err := (&dataDecoder{}).decodeEntry(typ, nil, c.Data)
+		if err != nil {
+			t.Errorf("%s: error decoding: %v", typ, err)
+			continue
+		}
+		if got := fmt.Sprint(decoded.(map[string]interface{})[typ]); n != et.Size || got != fmt.Sprint(value) {
+			t.Errorf("%s: expecting %d decoded from %d bytes, got %s from %d", typ, value, et.Size, got, n)
+		}
+	}
+}
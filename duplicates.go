@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiam/max7456tool/mcm"
+)
+
+const (
+	defaultBackupDir = ".max7456tool-backup"
+)
+
+// duplicateChar is a character in a font source which is
+// equal to the same character in one of its parents
+type duplicateChar struct {
+	Char   int
+	Parent string
+}
+
+// duplicateRemover removes the duplicate characters from the font
+// sources. Files are never deleted: PNGs with a single character
+// are moved to BackupDir, PNGs with several characters in a directory
+// are split into one file per remaining character and sheets get
+// the duplicate cells cleared. In both cases, the original file is
+// moved to BackupDir too.
+type duplicateRemover struct {
+	// DryRun only lists the changes to Out, without touching any file
+	DryRun bool
+	// BackupDir receives the original files, keeping their
+	// path relative to Dir
+	BackupDir string
+	Dir       string
+	Out       io.Writer
+
+	mu sync.Mutex
+}
+
+// newDuplicateRemover returns a duplicateRemover for sources relative to
+// dir. If backupDir is empty, defaultBackupDir inside dir is used. Each
+// remover uses its own subdirectory in it, named after the current time.
+func newDuplicateRemover(dir string, backupDir string, dryRun bool) *duplicateRemover {
+	if backupDir == "" {
+		backupDir = filepath.Join(dir, defaultBackupDir)
+	}
+	return &duplicateRemover{
+		DryRun:    dryRun,
+		BackupDir: filepath.Join(backupDir, time.Now().Format("20060102-150405")),
+		Dir:       dir,
+		Out:       os.Stdout,
+	}
+}
+
+// rel returns filename relative to r.Dir, or an empty
+// string if it's outside of it
+func (r *duplicateRemover) rel(filename string) string {
+	rel, err := filepath.Rel(r.Dir, filename)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return rel
+}
+
+func (r *duplicateRemover) displayName(filename string) string {
+	if rel := r.rel(filename); rel != "" {
+		return rel
+	}
+	return filename
+}
+
+// report prints msg in dry run mode and logs it as verbose otherwise
+func (r *duplicateRemover) report(log *prefixLogger, format string, v ...interface{}) error {
+	if !r.DryRun {
+		log.Verbose(format, v...)
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := fmt.Fprintln(r.Out, log.message(format, v...))
+	return err
+}
+
+// backup moves filename into the backup directory
+func (r *duplicateRemover) backup(filename string) (string, error) {
+	rel := r.rel(filename)
+	if rel == "" {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			return "", err
+		}
+		rel = strings.TrimLeft(abs[len(filepath.VolumeName(abs)):], string(filepath.Separator))
+	}
+	dst := filepath.Join(r.BackupDir, rel)
+	if _, err := os.Stat(dst); err == nil {
+		return "", fmt.Errorf("backup file %s already exists", dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(filename, dst); err != nil {
+		// Might be in another device
+		data, rerr := ioutil.ReadFile(filename)
+		if rerr != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(dst, data, 0644); err != nil {
+			return "", err
+		}
+		if err := os.Remove(filename); err != nil {
+			return "", err
+		}
+	}
+	return dst, nil
+}
+
+// Remove removes the duplicates from the source files, using prov
+// to find the file and cell of each character
+func (r *duplicateRemover) Remove(duplicates []duplicateChar, prov fontProvenance, log *prefixLogger) error {
+	// Group the characters by file
+	byFile := make(map[string][]duplicateChar)
+	var files []string
+	for _, d := range duplicates {
+		p := prov[d.Char]
+		if p == nil || p.File == "" {
+			continue
+		}
+		if byFile[p.File] == nil {
+			files = append(files, p.File)
+		}
+		byFile[p.File] = append(byFile[p.File], d)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		dups := byFile[f]
+		var err error
+		switch prov[dups[0].Char].Source {
+		case originImage:
+			err = r.removeFromImage(f, dups, prov, log)
+		case originSheet:
+			err = r.removeFromSheet(f, dups, prov, log)
+		}
+		if err != nil {
+			return fmt.Errorf("error removing duplicate characters from %s: %v", f, err)
+		}
+	}
+	return nil
+}
+
+func formatDuplicates(dups []duplicateChar) string {
+	items := make([]string, len(dups))
+	for ii, d := range dups {
+		items[ii] = fmt.Sprintf("%03d (equal to %s)", d.Char, d.Parent)
+	}
+	return strings.Join(items, ", ")
+}
+
+// removeFromImage removes the duplicates in a PNG inside a directory
+// source. If the image contains other characters, they're split into
+// a file for each one.
+func (r *duplicateRemover) removeFromImage(filename string, dups []duplicateChar, prov fontProvenance, log *prefixLogger) error {
+	duplicated := make(map[int]bool, len(dups))
+	for _, d := range dups {
+		duplicated[d.Char] = true
+	}
+	var keep []int
+	for n, p := range prov {
+		if p.File == filename && !duplicated[n] {
+			keep = append(keep, n)
+		}
+	}
+	sort.Ints(keep)
+	name := r.displayName(filename)
+	if len(keep) == 0 {
+		if r.DryRun {
+			return r.report(log, "would remove %s: %s", name, formatDuplicates(dups))
+		}
+		dst, err := r.backup(filename)
+		if err != nil {
+			return err
+		}
+		return r.report(log, "removed %s, moved to %s: %s", name, dst, formatDuplicates(dups))
+	}
+	dir := filepath.Dir(filename)
+	splitNames := make([]string, len(keep))
+	for ii, n := range keep {
+		splitNames[ii] = fmt.Sprintf("%03d.png", n)
+	}
+	if r.DryRun {
+		return r.report(log, "would split %s into %s: %s", name, strings.Join(splitNames, ", "), formatDuplicates(dups))
+	}
+	img, err := decodePNGFile(filename)
+	if err != nil {
+		return err
+	}
+	// Write all the split files before moving the original to the
+	// backup, so a failure leaves the source as it was
+	var written []string
+	removeWritten := func() {
+		for _, p := range written {
+			os.Remove(p)
+		}
+	}
+	for ii, n := range keep {
+		cell := prov[n].Cell
+		rect := image.Rect(cell.X, cell.Y, cell.X+mcm.CharWidth, cell.Y+mcm.CharHeight)
+		chrImg := image.NewRGBA(image.Rect(0, 0, mcm.CharWidth, mcm.CharHeight))
+		draw.Draw(chrImg, chrImg.Bounds(), img, rect.Min, draw.Src)
+		data, err := encodePNG(chrImg)
+		if err != nil {
+			removeWritten()
+			return err
+		}
+		p := filepath.Join(dir, splitNames[ii])
+		if err := writeNewFile(p, data); err != nil {
+			removeWritten()
+			return err
+		}
+		written = append(written, p)
+	}
+	dst, err := r.backup(filename)
+	if err != nil {
+		removeWritten()
+		return err
+	}
+	return r.report(log, "split %s into %s, original moved to %s: %s", name, strings.Join(splitNames, ", "), dst, formatDuplicates(dups))
+}
+
+// removeFromSheet clears the cells of the duplicates in a PNG with
+// the whole font, so they're filled from the parents
+func (r *duplicateRemover) removeFromSheet(filename string, dups []duplicateChar, prov fontProvenance, log *prefixLogger) error {
+	name := r.displayName(filename)
+	if r.DryRun {
+		return r.report(log, "would clear %d cells in %s: %s", len(dups), name, formatDuplicates(dups))
+	}
+	img, err := decodePNGFile(filename)
+	if err != nil {
+		return err
+	}
+	bounds := img.Bounds()
+	sheet := image.NewRGBA(bounds)
+	draw.Draw(sheet, bounds, img, bounds.Min, draw.Src)
+	blank := blankChar().Image(nil)
+	for _, d := range dups {
+		cell := prov[d.Char].Cell
+		rect := image.Rect(cell.X, cell.Y, cell.X+mcm.CharWidth, cell.Y+mcm.CharHeight)
+		draw.Draw(sheet, rect, blank, image.ZP, draw.Src)
+	}
+	data, err := encodePNG(sheet)
+	if err != nil {
+		return err
+	}
+	dst, err := r.backup(filename)
+	if err != nil {
+		return err
+	}
+	if err := writeNewFile(filename, data); err != nil {
+		return err
+	}
+	return r.report(log, "cleared %d cells in %s, original moved to %s: %s", len(dups), name, dst, formatDuplicates(dups))
+}
+
+func decodePNGFile(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, imfmt, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", filename, err)
+	}
+	if imfmt != "png" {
+		return nil, fmt.Errorf("%s: invalid image format %s, must be png", filename, imfmt)
+	}
+	return img, nil
+}
+
+// writeNewFile writes data to filename, failing if it already exists
+func writeNewFile(filename string, data []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,54 @@
+package main
+
+// entryType is a builtin type for the entries in the data and the
+// metadata of a character in the extra data. The same table is used
+// to encode the entries and to decode them back with dump-data.
+type entryType struct {
+	// Size is the size in bytes of the fixed size types,
+	// zero otherwise
+	Size int
+	// Encode appends v, the argument of the entry, to e
+	Encode func(e *entryEncoder, v interface{}) error
+	// Decode decodes an entry from the start of data, using v from
+	// the schema. It returns the decoded entry, which might use
+	// a different type if the data doesn't match the schema, and
+	// the number of bytes used.
+	Decode func(d *dataDecoder, typ string, v interface{}, data []byte) (interface{}, int, error)
+}
+
+// entryTypes contains all the builtin entry types, except the fixed
+// point ones, which are parsed from their name (see fixedpoint.go).
+// It's initialized in init() because some entries are encoded and
+// decoded recursively.
+var entryTypes map[string]*entryType
+
+func init() {
+	integer := func(size int) *entryType {
+		return &entryType{Size: size, Encode: encodeIntegerEntry, Decode: decodeIntegerEntry}
+	}
+	float := func(size int) *entryType {
+		return &entryType{Size: size, Encode: encodeFloatEntry, Decode: decodeIntegerEntry}
+	}
+	checksum := &entryType{Encode: encodeChecksumEntry, Decode: decodeChecksumEntry}
+	entryTypes = map[string]*entryType{
+		"s":   {Encode: encodeStringEntry, Decode: decodeBytesEntry},
+		"hex": {Encode: encodeHexEntry, Decode: decodeBytesEntry},
+		"b64": {Encode: encodeBase64Entry, Decode: decodeBytesEntry},
+		"c":   {Size: 1, Encode: encodeColorsEntry, Decode: decodeColorsEntry},
+
+		"u8": integer(1), "i8": integer(1),
+		"lu16": integer(2), "bu16": integer(2), "li16": integer(2), "bi16": integer(2),
+		"lu32": integer(4), "bu32": integer(4), "li32": integer(4), "bi32": integer(4),
+		"lu64": integer(8), "bu64": integer(8), "li64": integer(8), "bi64": integer(8),
+		"lf32": float(4), "bf32": float(4), "lf64": float(8), "bf64": float(8),
+
+		"bits": {Encode: encodeBitfieldEntry, Decode: decodeBitfieldEntry},
+		"file": {Encode: encodeFileEntry, Decode: decodeFileEntry},
+
+		"lcrc16": checksum, "bcrc16": checksum, "lcrc32": checksum, "bcrc32": checksum,
+		"sha256": checksum,
+
+		"timestamp": {Encode: encodeTimestampEntry, Decode: decodeTimestampEntry},
+		"define":    {Encode: encodeDefineEntry, Decode: decodeDefineEntry},
+	}
+}
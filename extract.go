@@ -35,18 +35,22 @@ func extractAction(ctx *cli.Context) error {
 		if !blanks && ch.IsBlank() {
 			continue
 		}
-		im := ch.Image(nil)
 		output := filepath.Join(dir, fmt.Sprintf("%03d", ii)+".png")
-		f, err := openOutputFile(output)
-		if err != nil {
-			return err
-		}
-		if err := png.Encode(f, im); err != nil {
-			return err
-		}
-		if err := f.Close(); err != nil {
+		if err := writeCharPNG(output, ch); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func writeCharPNG(output string, ch *mcm.Char) error {
+	f, err := openOutputFile(output)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, ch.Image(nil)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+var (
+	fixedPointTypeRe = regexp.MustCompile(`^([lb])(u?)q(\d+)\.(\d+)$`)
+)
+
+// fixedPointType represents a fixed point number with IntBits bits
+// for the integer part and FracBits for the fractional one. For signed
+// types, the sign bit is included in IntBits. Types are written as
+// lq8.8 (signed, little endian), bq16.16 (signed, big endian),
+// luq8.8 (unsigned, little endian), etc... The total number of
+// bits must be a multiple of 8, up to 64.
+type fixedPointType struct {
+	Name      string
+	ByteOrder binary.ByteOrder
+	Signed    bool
+	IntBits   uint
+	FracBits  uint
+}
+
+// parseFixedPointType returns the fixedPointType for the given name. If
+// the name doesn't represent a fixed point type, it returns nil and no
+// error. If the name is a fixed point type with an invalid size, it
+// returns an error.
+func parseFixedPointType(name string) (*fixedPointType, error) {
+	m := fixedPointTypeRe.FindStringSubmatch(name)
+	if m == nil {
+		return nil, nil
+	}
+	intBits, err := strconv.ParseUint(m[3], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid integer bits in %s: %v", name, err)
+	}
+	fracBits, err := strconv.ParseUint(m[4], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fractional bits in %s: %v", name, err)
+	}
+	total := intBits + fracBits
+	if total == 0 || total%8 != 0 || total > 64 {
+		return nil, fmt.Errorf("fixed point type %s has %d bits, must be a multiple of 8 up to 64", name, total)
+	}
+	signed := m[2] == ""
+	if signed && intBits == 0 {
+		return nil, fmt.Errorf("signed fixed point type %s needs at least 1 integer bit for the sign", name)
+	}
+	bo := binary.ByteOrder(binary.LittleEndian)
+	if m[1] == "b" {
+		bo = binary.BigEndian
+	}
+	return &fixedPointType{
+		Name:      name,
+		ByteOrder: bo,
+		Signed:    signed,
+		IntBits:   uint(intBits),
+		FracBits:  uint(fracBits),
+	}, nil
+}
+
+// Size returns the size of the type in bytes
+func (t *fixedPointType) Size() int {
+	return int(t.IntBits+t.FracBits) / 8
+}
+
+// Resolution returns the difference between two consecutive values
+func (t *fixedPointType) Resolution() float64 {
+	return math.Ldexp(1, -int(t.FracBits))
+}
+
+// Encode returns the encoded value for v. If v is out of range
+// or it can't be represented exactly, an error is returned.
+func (t *fixedPointType) Encode(v float64) ([]byte, error) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("can't encode %v as %s", v, t.Name)
+	}
+	total := t.IntBits + t.FracBits
+	scaled := math.Ldexp(v, int(t.FracBits))
+	// Bounds for the scaled value, min is inclusive while limit is exclusive
+	var min, limit float64
+	if t.Signed {
+		min = -math.Ldexp(1, int(total-1))
+		limit = math.Ldexp(1, int(total-1))
+	} else {
+		limit = math.Ldexp(1, int(total))
+	}
+	if scaled < min || scaled >= limit {
+		return nil, fmt.Errorf("can't encode %v as %s, valid range is [%v, %v]",
+			v, t.Name, math.Ldexp(min, -int(t.FracBits)), math.Ldexp(limit, -int(t.FracBits))-t.Resolution())
+	}
+	if scaled != math.Trunc(scaled) {
+		res := t.Resolution()
+		lower := math.Floor(scaled) * res
+		return nil, fmt.Errorf("can't encode %v as %s without losing precision, nearest values are %v and %v",
+			v, t.Name, lower, lower+res)
+	}
+	var raw uint64
+	if scaled < 0 {
+		raw = uint64(int64(scaled))
+	} else {
+		raw = uint64(scaled)
+	}
+	var data [8]byte
+	size := t.Size()
+	if t.ByteOrder == binary.ByteOrder(binary.LittleEndian) {
+		binary.LittleEndian.PutUint64(data[:], raw)
+		return data[:size], nil
+	}
+	binary.BigEndian.PutUint64(data[:], raw)
+	return data[8-size:], nil
+}
@@ -2,16 +2,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/fiam/max7456tool/mcm"
-	"gopkg.in/yaml.v2"
 )
 
 func toInt64(i interface{}) (int64, error) {
@@ -33,18 +36,110 @@ func toInt64(i interface{}) (int64, error) {
 	}
 }
 
+func toFloat64(i interface{}) (float64, error) {
+	switch x := i.(type) {
+	case int:
+		return float64(x), nil
+	case float64:
+		return x, nil
+	case string:
+		return strconv.ParseFloat(x, 64)
+	default:
+		return 0, fmt.Errorf("can't convert %T to float64", i)
+	}
+}
+
+func parsePixelColor(s string) (mcm.Pixel, error) {
+	switch strings.ToUpper(s) {
+	case "BLACK":
+		return mcm.PixelBlack, nil
+	case "WHITE":
+		return mcm.PixelWhite, nil
+	case "TRANSPARENT":
+		return mcm.PixelTransparent, nil
+	case "GREY":
+		fallthrough
+	case "GRAY":
+		return mcm.PixelGray, nil
+	}
+	return 0, fmt.Errorf("unknown color %q", s)
+}
+
+// extraDataContext contains the information required to
+// parse the values in an extra data file
+type extraDataContext struct {
+	// Dir is used to resolve relative paths
+	Dir string
+	// Defines contains the values for define entries
+	Defines map[string]string
+	// Types contains the struct types declared in the file
+	Types map[string]*structType
+	// Source and Key are used to record the source of each
+	// entry and to report errors. Key is the key of the
+	// character being parsed in the file.
+	Source *yamlFile
+	Key    string
+	// Inputs, if non nil, receives the files read
+	// by file entries
+	Inputs *[]string
+}
+
+// nested returns a copy of ec for encoding values generated from
+// an entry, which must not record their sources.
+func (ec *extraDataContext) nested() *extraDataContext {
+	n := *ec
+	n.Source = nil
+	return &n
+}
+
+func (ec *extraDataContext) source(section string, index int, offset int, size int) *dataSource {
+	var line int
+	if index >= 0 {
+		line = ec.Source.Line(ec.Key, section, index)
+	} else {
+		line = ec.Source.Line(ec.Key, section)
+	}
+	return &dataSource{
+		File:     ec.Source.Name,
+		Line:     line,
+		Metadata: section == "metadata",
+		Offset:   offset,
+		Size:     size,
+	}
+}
+
 type charBinaryData struct {
 	Data     []byte
 	Metadata []byte
+	// Payload is the first character of the payload this
+	// character belongs to, or -1 if it's not part of a payload
+	Payload int
+	// Computed contains the fields that must be resolved
+	// once the font has been assembled
+	Computed []*computedField
+	// Sources contains the origin of each entry
+	Sources []*dataSource
 }
 
-func (c *charBinaryData) MergeTo(n int, chr *mcm.Char) (*mcm.Char, error) {
+func newCharBinaryData() *charBinaryData {
+	return &charBinaryData{Payload: -1}
+}
+
+func (c *charBinaryData) MergeTo(n int, chr *mcm.Char, log *prefixLogger) (*mcm.Char, error) {
+	if c.Payload >= 0 {
+		return nil, fmt.Errorf("payload starting at %d overlaps existing character %03d", c.Payload, n)
+	}
 	if len(c.Data) > 0 {
 		return nil, fmt.Errorf("character %03d has both visible extra data", n)
 	}
+	maxMetadata := mcm.CharBytes - mcm.MinCharBytes
+	if len(c.Metadata) > maxMetadata {
+		return nil, fmt.Errorf("character %03d metadata with %d bytes exceeds the maximum %d",
+			n, len(c.Metadata), maxMetadata)
+	}
 	data := chr.Data()
 	if len(c.Metadata) > 0 {
-		logDebug("adding metadata %v to character %03d", c.Metadata, n)
+		log.Debug("adding metadata %v to character %03d", c.Metadata, n)
 	}
 	if len(data) == mcm.CharBytes && len(c.Metadata) > 0 {
 		charMeta := data[mcm.MinCharBytes:]
@@ -60,7 +155,7 @@ func (c *charBinaryData) MergeTo(n int, chr *mcm.Char) (*mcm.Char, error) {
 			}
 		}
 		if !isTransparent {
-			logVerbose("overriding metadata in %03d from %v to %v", n, charMeta, c.Metadata)
+			log.Verbose("overriding metadata in %03d from %v to %v", n, charMeta, c.Metadata)
 		}
 	}
 	var buf bytes.Buffer
@@ -85,10 +180,6 @@ func (c *charBinaryData) MergeTo(n int, chr *mcm.Char) (*mcm.Char, error) {
 
 func (c *charBinaryData) Char() (*mcm.Char, error) {
 	total := len(c.Data) + len(c.Metadata)
-	if total > mcm.CharBytes {
-		return nil, fmt.Errorf("character has too many bytes (%d+%d)=%d > %d",
-			len(c.Data), len(c.Metadata), total, mcm.CharBytes)
-	}
 	if total == 0 {
 		return nil, errors.New("character is empty")
 	}
@@ -97,6 +188,14 @@ func (c *charBinaryData) Char() (*mcm.Char, error) {
 		return nil, fmt.Errorf("character metadata with %d bytes exceeds the maximum %d",
 			len(c.Metadata), maxMetadata)
 	}
+	if len(c.Metadata) > 0 && len(c.Data) > mcm.MinCharBytes {
+		return nil, fmt.Errorf("character data with %d bytes overlaps its metadata, data can't exceed %d bytes when metadata is present",
+			len(c.Data), mcm.MinCharBytes)
+	}
+	if total > mcm.CharBytes {
+		return nil, fmt.Errorf("character data with %d bytes exceeds the maximum %d",
+			len(c.Data), mcm.CharBytes)
+	}
 	var buf bytes.Buffer
 	if len(c.Data) > 0 {
 		if _, err := buf.Write(c.Data); err != nil {
@@ -122,7 +221,245 @@ func (c *charBinaryData) Char() (*mcm.Char, error) {
 	return mcm.NewCharFromData(buf.Bytes())
 }
 
-func (c *charBinaryData) addValues(m map[interface{}]interface{}, key string, data *[]byte) error {
+// entryEncoder encodes a single entry in charBinaryData.addValues
+type entryEncoder struct {
+	c   *charBinaryData
+	typ string
+	key string
+	ec  *extraDataContext
+	// data contains the data encoded before the call to addValues,
+	// while buf contains the entries encoded by it so far
+	data *[]byte
+	buf  *bytes.Buffer
+}
+
+// offset returns the offset of the entry being encoded
+func (e *entryEncoder) offset() int {
+	return len(*e.data) + e.buf.Len()
+}
+
+// encodeNested encodes entries after the previous data, so offsets for
+// computed fields are correct
+func (e *entryEncoder) encodeNested(entries []interface{}) error {
+	encoded := append(append([]byte(nil), *e.data...), e.buf.Bytes()...)
+	prefix := len(encoded)
+	if err := e.c.addValues(map[interface{}]interface{}{e.key: entries}, e.key, e.ec.nested(), &encoded); err != nil {
+		return fmt.Errorf("%s: %v", e.typ, err)
+	}
+	_, err := e.buf.Write(encoded[prefix:])
+	return err
+}
+
+func encodeStringEntry(e *entryEncoder, v interface{}) error {
+	vs, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("argument to s must be a string, it's %v (%T)", v, v)
+	}
+	_, err := e.buf.Write([]byte(vs))
+	return err
+}
+
+// encodeIntegerEntry encodes the integer types, named as
+// [l|b][u|i]<bits> (u8 and i8 have no byte order)
+func encodeIntegerEntry(e *entryEncoder, v interface{}) error {
+	i, err := toInt64(v)
+	if err != nil {
+		return err
+	}
+	size := entryTypes[e.typ].Size
+	bits := uint(size * 8)
+	name := fmt.Sprintf("uint%d", bits)
+	if strings.Contains(e.typ, "i") {
+		name = fmt.Sprintf("int%d", bits)
+		if bits < 64 && (i < -(1<<(bits-1)) || i > 1<<(bits-1)-1) {
+			return fmt.Errorf("can't encode %v as %s", i, name)
+		}
+	} else if bits < 64 && i > 1<<bits-1 {
+		return fmt.Errorf("can't encode %v as %s", i, name)
+	}
+	var buf [8]byte
+	if e.typ[0] == 'b' {
+		binary.BigEndian.PutUint64(buf[:], uint64(i))
+		_, err = e.buf.Write(buf[8-size:])
+	} else {
+		binary.LittleEndian.PutUint64(buf[:], uint64(i))
+		_, err = e.buf.Write(buf[:size])
+	}
+	return err
+}
+
+func encodeFloatEntry(e *entryEncoder, v interface{}) error {
+	f, err := toFloat64(v)
+	if err != nil {
+		return err
+	}
+	bo := binary.ByteOrder(binary.LittleEndian)
+	if e.typ[0] == 'b' {
+		bo = binary.BigEndian
+	}
+	if entryTypes[e.typ].Size == 8 {
+		if !isExactFloat(v, f, f, 64) {
+			return fmt.Errorf("can't encode %v as float64 without losing precision, nearest value is %v", v, f)
+		}
+		return binary.Write(e.buf, bo, f)
+	}
+	f32 := float32(f)
+	if math.IsInf(float64(f32), 0) && !math.IsInf(f, 0) {
+		return fmt.Errorf("can't encode %v as float32, it overflows", f)
+	}
+	if f32 == 0 && f != 0 {
+		return fmt.Errorf("can't encode %v as float32, it underflows to zero", f)
+	}
+	if !isExactFloat(v, f, float64(f32), 32) {
+		return fmt.Errorf("can't encode %v as float32 without losing precision, nearest value is %v", v, f32)
+	}
+	return binary.Write(e.buf, bo, f32)
+}
+
+// isExactFloat returns true iff encoded, the value v (parsed as f)
+// converted to a float with the given number of bits, doesn't lose
+// precision. Integers must be represented exactly, while other values
+// must keep all their significant digits, so 0.1 is accepted as a
+// float32 but 0.123456789 is not.
+func isExactFloat(v interface{}, f float64, encoded float64, bits int) bool {
+	if n, isInt := v.(int); isInt {
+		// float64(math.MaxInt64) rounds up to 2^63, which
+		// doesn't fit in an int64
+		return encoded < 1<<63 && int64(encoded) == int64(n)
+	}
+	parsed, err := strconv.ParseFloat(strconv.FormatFloat(encoded, 'g', -1, bits), 64)
+	return err == nil && parsed == f
+}
+
+func encodeBitfieldEntry(e *entryEncoder, v interface{}) error {
+	bf, err := parseBitfield(v)
+	if err != nil {
+		return err
+	}
+	data, err := bf.Bytes()
+	if err != nil {
+		return err
+	}
+	_, err = e.buf.Write(data)
+	return err
+}
+
+func encodeHexEntry(e *entryEncoder, v interface{}) error {
+	vs, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("argument to hex must be a string, it's %v (%T)", v, v)
+	}
+	// Allow separating bytes with spaces or colons
+	vs = strings.NewReplacer(" ", "", ":", "", "\n", "").Replace(vs)
+	data, err := hex.DecodeString(vs)
+	if err != nil {
+		return fmt.Errorf("invalid hex data %q: %v", vs, err)
+	}
+	_, err = e.buf.Write(data)
+	return err
+}
+
+func encodeBase64Entry(e *entryEncoder, v interface{}) error {
+	vs, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("argument to b64 must be a string, it's %v (%T)", v, v)
+	}
+	vs = strings.NewReplacer(" ", "", "\n", "").Replace(vs)
+	enc := base64.StdEncoding
+	if !strings.HasSuffix(vs, "=") {
+		enc = base64.RawStdEncoding
+	}
+	data, err := enc.DecodeString(vs)
+	if err != nil {
+		return fmt.Errorf("invalid base64 data %q: %v", vs, err)
+	}
+	_, err = e.buf.Write(data)
+	return err
+}
+
+func encodeFileEntry(e *entryEncoder, v interface{}) error {
+	vs, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("argument to file must be a string, it's %v (%T)", v, v)
+	}
+	if !filepath.IsAbs(vs) {
+		vs = filepath.Join(e.ec.Dir, vs)
+	}
+	data, err := ioutil.ReadFile(vs)
+	if err != nil {
+		return fmt.Errorf("error reading data file: %v", err)
+	}
+	if e.ec.Inputs != nil {
+		*e.ec.Inputs = append(*e.ec.Inputs, vs)
+	}
+	_, err = e.buf.Write(data)
+	return err
+}
+
+func encodeChecksumEntry(e *entryEncoder, v interface{}) error {
+	f, err := parseChecksumField(e.typ, v)
+	if err != nil {
+		return err
+	}
+	f.Metadata = e.key == "metadata"
+	f.Offset = e.offset()
+	e.c.Computed = append(e.c.Computed, f)
+	_, err = e.buf.Write(make([]byte, f.Size))
+	return err
+}
+
+func encodeTimestampEntry(e *entryEncoder, v interface{}) error {
+	value, err := timestampValue(v)
+	if err != nil {
+		return err
+	}
+	return e.encodeNested([]interface{}{value})
+}
+
+func encodeDefineEntry(e *entryEncoder, v interface{}) error {
+	value, err := defineValue(v, e.ec.Defines)
+	if err != nil {
+		return err
+	}
+	return e.encodeNested([]interface{}{value})
+}
+
+func encodeColorsEntry(e *entryEncoder, v interface{}) error {
+	vs, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("argument to c must be a string, it's %v (%T)", v, v)
+	}
+	parts := strings.Split(vs, ",")
+	if len(parts) > 4 {
+		return fmt.Errorf("%q contains %d color, the maximum is 4", vs, len(parts))
+	}
+	val := uint8(0)
+	shift := uint(0)
+	for ii, p := range parts {
+		p = strings.TrimSpace(p)
+		pixel, err := parsePixelColor(p)
+		if err != nil {
+			return fmt.Errorf("%v at position %d", err, ii)
+		}
+		val |= uint8(pixel) << shift
+		shift += 2
+	}
+	return e.buf.WriteByte(val)
+}
+
+// addValues encodes the values in m[key] and appends them to data.
+func (c *charBinaryData) addValues(m map[interface{}]interface{}, key string, ec *extraDataContext, data *[]byte) (err error) {
+	entry := -1
+	defer func() {
+		// Point errors to the entry that caused them
+		if err != nil && ec.Source != nil {
+			if entry >= 0 {
+				err = ec.Source.Wrap(err, ec.Key, key, entry)
+			} else {
+				err = ec.Source.Wrap(err, ec.Key, key)
+			}
+		}
+	}()
 	val := m[key]
 	if val != nil {
 		slice, ok := val.([]interface{})
@@ -131,6 +468,7 @@ func (c *charBinaryData) addValues(m map[interface{}]interface{}, key string, da
 		}
 		var buf bytes.Buffer
 		for ii, v := range slice {
+			entry = ii
 			vm, ok := v.(map[interface{}]interface{})
 			if !ok {
 				return fmt.Errorf("key %s, entry %d is not a map, it's %T", key, ii, v)
@@ -138,178 +476,49 @@ func (c *charBinaryData) addValues(m map[interface{}]interface{}, key string, da
 			if len(vm) != 1 {
 				return fmt.Errorf("map in key %s at entry %d contains %d keys", key, ii+1, len(vm))
 			}
+			start := len(*data) + buf.Len()
 			for kk, vv := range vm {
 				ks, ok := kk.(string)
 				if !ok {
 					return fmt.Errorf("key %v inside %s is not string, it's %T", kk, key, kk)
 				}
-				switch ks {
-				case "s":
-					vs, ok := vv.(string)
-					if !ok {
-						return fmt.Errorf("argument to s must be a string, it's %v (%T)", vv, vv)
-					}
-					if _, err := buf.Write([]byte(vs)); err != nil {
-						return err
-					}
-				case "u8":
-					i, err := toInt64(vv)
-					if err != nil {
+				e := &entryEncoder{c: c, typ: ks, key: key, ec: ec, data: data, buf: &buf}
+				if et := entryTypes[ks]; et != nil {
+					if err := et.Encode(e, vv); err != nil {
 						return err
 					}
-					if i > math.MaxUint8 {
-						return fmt.Errorf("can't encode %v as uint8", i)
-					}
-					if err := buf.WriteByte(byte(i)); err != nil {
-						return err
-					}
-				case "i8":
-					i, err := toInt64(vv)
-					if err != nil {
-						return err
-					}
-					if i < math.MinInt8 || i > math.MaxInt8 {
-						return fmt.Errorf("can't encode %v as int8", i)
-					}
-					if err := buf.WriteByte(byte(i)); err != nil {
-						return err
-					}
-				case "lu16":
-					fallthrough
-				case "bu16":
-					i, err := toInt64(vv)
-					if err != nil {
-						return err
-					}
-					if i > math.MaxUint16 {
-						return fmt.Errorf("can't encode %v as uint16", i)
-					}
-					bo := binary.ByteOrder(binary.LittleEndian)
-					if ks == "bu16" {
-						bo = binary.BigEndian
-					}
-					if err := binary.Write(&buf, bo, uint16(i)); err != nil {
-						return err
-					}
-				case "li16":
-					fallthrough
-				case "bi16":
-					i, err := toInt64(vv)
-					if err != nil {
-						return err
-					}
-					if i < math.MinInt16 || i > math.MaxInt16 {
-						return fmt.Errorf("can't encode %v as int16", i)
-					}
-					bo := binary.ByteOrder(binary.LittleEndian)
-					if ks == "bi16" {
-						bo = binary.BigEndian
-					}
-					if err := binary.Write(&buf, bo, int16(i)); err != nil {
-						return err
-					}
-				case "lu32":
-					fallthrough
-				case "bu32":
-					i, err := toInt64(vv)
-					if err != nil {
-						return err
-					}
-					if i > math.MaxUint32 {
-						return fmt.Errorf("can't encode %v as uint32", i)
-					}
-					bo := binary.ByteOrder(binary.LittleEndian)
-					if ks == "bu32" {
-						bo = binary.BigEndian
-					}
-					if err := binary.Write(&buf, bo, uint32(i)); err != nil {
-						return err
-					}
-				case "li32":
-					fallthrough
-				case "bi32":
-					i, err := toInt64(vv)
+					continue
+				}
+				if st := ec.Types[ks]; st != nil {
+					entries, err := st.Expand(vv)
 					if err != nil {
 						return err
 					}
-					if i < math.MinInt32 || i > math.MaxInt32 {
-						return fmt.Errorf("can't encode %v as int32", i)
-					}
-					bo := binary.ByteOrder(binary.LittleEndian)
-					if ks == "bi32" {
-						bo = binary.BigEndian
-					}
-					if err := binary.Write(&buf, bo, int32(i)); err != nil {
+					if err := e.encodeNested(entries); err != nil {
 						return err
 					}
-				case "lu64":
-					fallthrough
-				case "bu64":
-					i, err := toInt64(vv)
+					continue
+				}
+				if fp, err := parseFixedPointType(ks); err != nil {
+					return err
+				} else if fp != nil {
+					f, err := toFloat64(vv)
 					if err != nil {
 						return err
 					}
-					bo := binary.ByteOrder(binary.LittleEndian)
-					if ks == "bu64" {
-						bo = binary.BigEndian
-					}
-					if err := binary.Write(&buf, bo, uint64(i)); err != nil {
-						return err
-					}
-				case "li64":
-					fallthrough
-				case "bi64":
-					i, err := toInt64(vv)
+					data, err := fp.Encode(f)
 					if err != nil {
 						return err
 					}
-					if i < math.MinInt64 || i > math.MaxInt64 {
-						return fmt.Errorf("can't encode %v as iint32", i)
-					}
-					bo := binary.ByteOrder(binary.LittleEndian)
-					if ks == "bi64" {
-						bo = binary.BigEndian
-					}
-					if err := binary.Write(&buf, bo, int64(i)); err != nil {
-						return err
-					}
-				case "c":
-					vs, ok := vv.(string)
-					if !ok {
-						return fmt.Errorf("argument to c must be a string, it's %v (%T)", vv, vv)
-					}
-					parts := strings.Split(vs, ",")
-					if len(parts) > 4 {
-						return fmt.Errorf("%q contains %d color, the maximum is 4", vs, len(parts))
-					}
-					val := uint8(0)
-					shift := uint(0)
-					for ii, p := range parts {
-						p = strings.TrimSpace(p)
-						var pixel mcm.Pixel
-						switch strings.ToUpper(p) {
-						case "BLACK":
-							pixel = mcm.PixelBlack
-						case "WHITE":
-							pixel = mcm.PixelWhite
-						case "TRANSPARENT":
-							pixel = mcm.PixelTransparent
-						case "GREY":
-							fallthrough
-						case "GRAY":
-							pixel = mcm.PixelGray
-						default:
-							return fmt.Errorf("unknown color %q at position %d", p, ii)
-						}
-						val |= uint8(pixel) << shift
-						shift += 2
-					}
-					if _, err := buf.Write([]byte{val}); err != nil {
+					if _, err := buf.Write(data); err != nil {
 						return err
 					}
-				default:
-					return fmt.Errorf("can't encode value with key %q within %s", ks, key)
+					continue
 				}
+				return fmt.Errorf("can't encode value with key %q within %s", ks, key)
+			}
+			if ec.Source != nil {
+				c.Sources = append(c.Sources, ec.source(key, ii, start, len(*data)+buf.Len()-start))
 			}
 		}
 		*data = append(*data, buf.Bytes()...)
@@ -317,15 +526,51 @@ func (c *charBinaryData) addValues(m map[interface{}]interface{}, key string, da
 	return nil
 }
 
-func (c *charBinaryData) Add(d interface{}) error {
+// Add parses the data and metadata in d and appends them to c.
+func (c *charBinaryData) Add(d interface{}, ec *extraDataContext) error {
 	m, ok := d.(map[interface{}]interface{})
 	if !ok {
 		return fmt.Errorf("can't add data from %T", d)
 	}
-	if err := c.addValues(m, "data", &c.Data); err != nil {
+	if c.Payload >= 0 {
+		return fmt.Errorf("character is part of the payload starting at %d", c.Payload)
+	}
+	for k := range m {
+		switch k {
+		case "data", "metadata", "pixels", mergeKey:
+		default:
+			return ec.Source.Wrap(fmt.Errorf("unknown key %v, valid keys are data, metadata, pixels, payload and %s", k, mergeKey), ec.Key, k)
+		}
+	}
+	if v := m["pixels"]; v != nil {
+		if m["data"] != nil {
+			return ec.Source.Wrap(errors.New("pixels can't be combined with data, use metadata instead"), ec.Key, "pixels")
+		}
+		if len(c.Data) > 0 {
+			return ec.Source.Wrap(fmt.Errorf("pixels would override %d bytes of existing data", len(c.Data)), ec.Key, "pixels")
+		}
+		pixels, err := parsePixelArt(v)
+		if err != nil {
+			if pe, ok := err.(*pixelArtError); ok && pe.Row > 0 {
+				if _, isList := v.([]interface{}); isList {
+					return ec.Source.Wrap(err, ec.Key, "pixels", pe.Row-1)
+				}
+			}
+			return ec.Source.Wrap(err, ec.Key, "pixels")
+		}
+		chr, err := mcm.NewCharFromPixels(pixels, nil)
+		if err != nil {
+			return err
+		}
+		c.Data = chr.Data()[:mcm.MinCharBytes]
+		if ec.Source != nil {
+			c.Sources = append(c.Sources, ec.source("pixels", -1, 0, mcm.MinCharBytes))
+		}
+	}
+	if err := c.addValues(m, "data", ec, &c.Data); err != nil {
 		return err
 	}
-	if err := c.addValues(m, "metadata", &c.Metadata); err != nil {
+	if err := c.addValues(m, "metadata", ec, &c.Metadata); err != nil {
 		return err
 	}
 	return nil
@@ -335,11 +580,26 @@ func (c *charBinaryData) Clone() *charBinaryData {
 	return &charBinaryData{
 		Data:     append([]byte(nil), c.Data...),
 		Metadata: append([]byte(nil), c.Metadata...),
+		Payload:  c.Payload,
+		Computed: append([]*computedField(nil), c.Computed...),
+		Sources:  append([]*dataSource(nil), c.Sources...),
 	}
 }
 
 type fontDataSet struct {
 	dataSet map[int]*charBinaryData
+	// Defines contains the values for define entries,
+	// set via --define
+	Defines map[string]string
+	// Merge is the merge mode used for files that don't
+	// declare one. If empty, mergeAppend is used.
+	Merge string
+	// Log is used for the messages while parsing and
+	// applying the data
+	Log *prefixLogger
+	// Inputs contains all the files read while parsing the
+	// data, including the ones referenced by file entries
+	Inputs []string
 }
 
 func newFontDataSet() *fontDataSet {
@@ -357,23 +617,130 @@ func (fs *fontDataSet) ParseFile(filename string) error {
 	if err != nil {
 		return err
 	}
-	var m map[int]interface{}
-	if err := yaml.Unmarshal(data, &m); err != nil {
-		return err
+	source, err := parseYAMLFile(filename, data)
+	if err != nil {
+		return fmt.Errorf("error parsing extra data: %v", err)
 	}
-	for k, v := range m {
-		chr := fs.dataSet[k]
-		if chr == nil {
-			chr = &charBinaryData{}
-			fs.dataSet[k] = chr
+	raw, err := yamlMapValue(source.Root)
+	if err != nil {
+		return fmt.Errorf("error parsing extra data from %s: %v", filename, err)
+	}
+	ef, err := splitExtraData(raw, filepath.Dir(filename), source, fs.Log)
+	if err != nil {
+		return fmt.Errorf("error parsing extra data: %v", err)
+	}
+	ec := &extraDataContext{
+		Dir:     filepath.Dir(filename),
+		Defines: fs.Defines,
+		Types:   ef.Types,
+		Source:  source,
+		Inputs:  &fs.Inputs,
+	}
+	fs.Inputs = append(fs.Inputs, filename)
+	payloads, err := fs.parsePayloads(ef, ec)
+	if err != nil {
+		return fmt.Errorf("error parsing extra data: %v", err)
+	}
+	fileMode := ef.Merge
+	if fileMode == "" {
+		fileMode = fs.Merge
+	}
+	for _, k := range sortedKeys(ef.Chars) {
+		if payloads[k] != nil {
+			continue
 		}
-		if err := chr.Add(v); err != nil {
-			return fmt.Errorf("error parsing extra data from %s: %v", filename, err)
+		v := ef.Chars[k]
+		ec.Key = ef.Keys[k]
+		mode := fileMode
+		if vm, ok := v.(map[interface{}]interface{}); ok && vm[mergeKey] != nil {
+			if mode, err = parseMergeMode(vm[mergeKey]); err != nil {
+				return fmt.Errorf("error parsing extra data: %v", source.Wrap(err, ec.Key, mergeKey))
+			}
+		}
+		chr, err := fs.merge(k, mode, filename)
+		if err != nil {
+			return fmt.Errorf("error parsing extra data: %v", source.Wrap(err, ec.Key))
+		}
+		if err := chr.Add(v, ec); err != nil {
+			return fmt.Errorf("error parsing extra data: %v", source.Wrap(withContext(err, fmt.Sprintf("character %d", k)), ec.Key))
+		}
+	}
+	for k, chunks := range payloads {
+		for ii, chunk := range chunks {
+			fs.Log.Debug("adding %d bytes from payload at %d to character %03d", len(chunk), k, k+ii)
+			fs.dataSet[k+ii] = &charBinaryData{
+				Data:    chunk,
+				Payload: k,
+				Sources: []*dataSource{{
+					File:   filename,
+					Line:   source.Line(ef.Keys[k], "payload"),
+					Offset: 0,
+					Size:   len(chunk),
+				}},
+			}
 		}
 	}
 	return nil
 }
 
+func sortedKeys(m map[int]interface{}) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// parsePayloads parses all the payloads in ef, returning the data for each
+// character indexed by the first character of the payload. If any
+// payload overlaps another character in ef or in the data set, an error
+// is returned.
+func (fs *fontDataSet) parsePayloads(ef *extraDataFile, ec *extraDataContext) (map[int][][]byte, error) {
+	payloads := make(map[int][][]byte)
+	used := make(map[int]int)
+	m := ef.Chars
+	for _, k := range sortedKeys(m) {
+		vm, ok := m[k].(map[interface{}]interface{})
+		if !ok || vm["payload"] == nil {
+			continue
+		}
+		key := ef.Keys[k]
+		if len(vm) != 1 {
+			return nil, ec.Source.Wrap(fmt.Errorf("character %d: payload can't be combined with other keys", k), key)
+		}
+		pec := *ec
+		pec.Key = yamlPath(key, "payload")
+		p, err := parsePayload(vm["payload"], &pec)
+		if err != nil {
+			return nil, ec.Source.Wrap(withContext(err, fmt.Sprintf("character %d", k)), key, "payload")
+		}
+		chunks, err := p.Chunks()
+		if err != nil {
+			return nil, ec.Source.Wrap(withContext(err, fmt.Sprintf("character %d", k)), key, "payload")
+		}
+		last := k + len(chunks) - 1
+		if last >= mcm.ExtendedCharNum {
+			return nil, ec.Source.Wrap(fmt.Errorf("payload at %d with %d bytes requires characters up to %d, maximum is %d",
+				k, len(p.Data), last, mcm.ExtendedCharNum-1), key, "payload")
+		}
+		for n := k; n <= last; n++ {
+			if _, found := fs.dataSet[n]; found {
+				return nil, ec.Source.Wrap(fmt.Errorf("payload at %d (characters %d-%d) overlaps existing extra data in character %d", k, k, last, n), key, "payload")
+			}
+			if _, found := m[n]; found && n != k {
+				return nil, ec.Source.Wrap(fmt.Errorf("payload at %d (characters %d-%d) overlaps character %d", k, k, last, n), key, "payload")
+			}
+			if prev, found := used[n]; found {
+				return nil, ec.Source.Wrap(fmt.Errorf("payload at %d (characters %d-%d) overlaps payload at %d", k, k, last, prev), key, "payload")
+			}
+			used[n] = k
+		}
+		payloads[k] = chunks
+	}
+	return payloads, nil
+}
+
 func (fs *fontDataSet) Clone() *fontDataSet {
 	dataSet := make(map[int]*charBinaryData, len(fs.dataSet))
 	for k, v := range fs.dataSet {
@@ -381,6 +748,10 @@ func (fs *fontDataSet) Clone() *fontDataSet {
 	}
 	return &fontDataSet{
 		dataSet: dataSet,
+		Defines: fs.Defines,
+		Merge:   fs.Merge,
+		Log:     fs.Log,
+		Inputs:  append([]string(nil), fs.Inputs...),
 	}
 }
 
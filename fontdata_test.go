@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fiam/max7456tool/mcm"
+)
+
+// testDecodeYAML decodes data into generic values, with maps
+// decoded as map[interface{}]interface{}
+func testDecodeYAML(t *testing.T, data string) interface{} {
+	v, err := decodeYAML([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func testDecodeYAMLMap(t *testing.T, data string) map[interface{}]interface{} {
+	m, ok := testDecodeYAML(t, data).(map[interface{}]interface{})
+	if !ok {
+		t.Fatalf("%q is not a map", data)
+	}
+	return m
+}
+
+func testCharBinaryData(t *testing.T, data string) (*charBinaryData, error) {
+	m := testDecodeYAML(t, data)
+	c := newCharBinaryData()
+	err := c.Add(m, &extraDataContext{Dir: "_testdata", Defines: map[string]string{"VERSION": "1.2", "REV": "7"}})
+	return c, err
+}
+
+func TestExtraDataValues(t *testing.T) {
+	testCases := []struct {
+		yaml     string
+		expected string
+		err      string
+	}{
+		{yaml: "{s: 'o'}, {i8: -1}, {lu16: 0x1234}", expected: "6fff3412"},
+		{yaml: "{lf32: 1.5}", expected: "0000c03f"},
+		{yaml: "{bf32: -2}", expected: "c0000000"},
+		{yaml: "{bf64: 0.1}", expected: "3fb999999999999a"},
+		{yaml: "{lf32: 1e39}", err: "overflows"},
+		{yaml: "{lf32: 1e-50}", err: "underflows"},
+		{yaml: "{lf32: 16777216}", expected: "0000804b"},
+		{yaml: "{lf32: 16777217}", err: "losing precision"},
+		{yaml: "{lf32: 0.1}", expected: "cdcccc3d"},
+		{yaml: "{lf32: 3.14159265}", err: "losing precision"},
+		{yaml: "{bf32: '16777217'}", err: "losing precision"},
+		{yaml: "{lf64: 9007199254740992}", expected: "0000000000004043"},
+		{yaml: "{lf64: 9007199254740993}", err: "losing precision"},
+		{yaml: "{bf64: 9223372036854775807}", err: "losing precision"},
+		{yaml: "{lq8.8: 1.5}", expected: "8001"},
+		{yaml: "{bq8.8: -1.5}", expected: "fe80"},
+		{yaml: "{bq16.16: 0.25}", expected: "00004000"},
+		{yaml: "{luq4.4: 15.9375}", expected: "ff"},
+		{yaml: "{lq8.8: 128}", err: "valid range is [-128, 127.99609375]"},
+		{yaml: "{luq8.8: -1}", err: "valid range"},
+		{yaml: "{lq8.8: 0.1}", err: "losing precision"},
+		{yaml: "{lq8.4: 1}", err: "must be a multiple of 8"},
+		{yaml: "{hex: 'de ad:be ef'}", expected: "deadbeef"},
+		{yaml: "{hex: 'abc'}", err: "invalid hex data"},
+		{yaml: "{b64: '3q2+7w=='}, {b64: '3q2+7w'}", expected: "deadbeefdeadbeef"},
+		{yaml: "{file: blob.bin}, {u8: 5}", expected: "0102030405"},
+		{yaml: "{file: missing.bin}", err: "error reading data file"},
+		{yaml: "{define: VERSION}, {define: {name: REV, type: u8}}, {define: {name: MISSING, type: lu16, default: 0x102}}", expected: "312e32070201"},
+		{yaml: "{define: MISSING}", err: "MISSING is not defined"},
+		{yaml: "{define: {name: VERSION, size: 4}}, {u8: 1}", expected: "312e320001"},
+		{yaml: "{define: {name: VERSION, size: 2}}", err: "maximum is 2"},
+		{yaml: "{define: {name: REV, type: u8, size: 2}}", err: "only valid for strings"},
+		{yaml: "{bits: {fields: [{width: 2, value: 1}, {width: 2, value: 0}, {width: 4, value: 0xa}]}}", expected: "a1"},
+		{yaml: "{bits: {order: msb, fields: [{width: 2, value: 1}, {width: 2, value: 0}, {width: 4, value: 0xa}]}}", expected: "4a"},
+		{yaml: "{bits: {order: msb, fields: [{width: 1, value: true}, {width: 12, value: 0xabc}, {width: 3, value: 0}]}}", expected: "d5e0"},
+		{yaml: "{bits: {fields: [{name: mode, width: 2, value: 4}, {width: 6, value: 0}]}}", err: "value 4 in field \"mode\" doesn't fit in 2 bits"},
+		{yaml: "{bits: {fields: [{width: 2, value: 1}, {width: 4, value: 0}]}}", err: "add up to 6 bits"},
+	}
+	for _, tc := range testCases {
+		c, err := testCharBinaryData(t, "metadata: ["+tc.yaml+"]")
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expecting error containing %q, got %v", tc.yaml, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.yaml, err)
+			continue
+		}
+		if got := hex.EncodeToString(c.Metadata); got != tc.expected {
+			t.Errorf("%s: expecting %s, got %s", tc.yaml, tc.expected, got)
+		}
+	}
+}
+
+func TestCRC16(t *testing.T) {
+	if crc := crc16([]byte("123456789")); crc != 0x29b1 {
+		t.Errorf("expecting CRC16 0x29b1, got 0x%04x", crc)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	long := strings.Repeat("0123456789", 20)
+	data := `
+10:
+  payload:
+    length: true
+    crc: crc32
+    data:
+      - s: "` + long + `"
+      - file: blob.bin
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "blob.bin"), []byte{1, 2, 3}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "data.yaml")
+	if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := newFontDataSet()
+	if err := fs.ParseFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	// 2 bytes length + 4 bytes CRC + 203 bytes = 209 bytes, 4 characters
+	chars := make([]*mcm.Char, mcm.CharNum)
+	for ii := 10; ii < 14; ii++ {
+		v := fs.Values()[ii]
+		if v == nil {
+			t.Fatalf("missing payload character %d", ii)
+		}
+		if chars[ii], err = v.Char(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fs.Values()[14] != nil {
+		t.Fatal("payload uses too many characters")
+	}
+	decoded, err := decodePayload(chars, 10, 0, &payloadOptions{Length: true, CRC: crcTypeCRC32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := append([]byte(long), 1, 2, 3); !bytes.Equal(decoded, expected) {
+		t.Fatalf("expecting payload %q, got %q", expected, decoded)
+	}
+
+	overlapping := filepath.Join(dir, "overlap.yaml")
+	if err := ioutil.WriteFile(overlapping, []byte("12:\n  data:\n    - u8: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ParseFile(overlapping); err == nil || !strings.Contains(err.Error(), "payload starting at 10") {
+		t.Fatalf("expecting overlap error, got %v", err)
+	}
+}
+
+func TestPayloadOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "data.yaml")
+	testCases := []struct {
+		options  string
+		opts     payloadOptions
+		count    int
+		expected string
+		err      string
+	}{
+		{options: "length: true, crc: crc16", opts: payloadOptions{Length: true, CRC: crcTypeCRC16}, expected: "abc"},
+		{options: "length: true", opts: payloadOptions{Length: true}, expected: "abc"},
+		// Without length, the padding is returned too
+		{options: "length: false", count: 1, expected: "abc" + strings.Repeat("\x55", mcm.CharBytes-3)},
+		{options: "crc: crc32", opts: payloadOptions{CRC: crcTypeCRC32}, err: "payload crc requires length"},
+	}
+	for _, tc := range testCases {
+		data := "10: {payload: {" + tc.options + ", data: [{s: 'abc'}]}}"
+		if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fs := newFontDataSet()
+		err := fs.ParseFile(filename)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expecting error %q, got %v", tc.options, tc.err, err)
+			}
+			// Decoding must fail too
+			if _, err := decodePayload([]*mcm.Char{blankChar()}, 0, 1, &tc.opts); err == nil {
+				t.Errorf("%s: expecting an error decoding", tc.options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.options, err)
+			continue
+		}
+		chars := make([]*mcm.Char, 11)
+		if chars[10], err = fs.Values()[10].Char(); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodePayload(chars, 10, tc.count, &tc.opts)
+		if err != nil {
+			t.Errorf("%s: error decoding: %v", tc.options, err)
+			continue
+		}
+		if string(decoded) != tc.expected {
+			t.Errorf("%s: expecting payload %q, got %q", tc.options, tc.expected, decoded)
+		}
+	}
+}
+
+func TestTimestampValue(t *testing.T) {
+	defer os.Setenv(sourceDateEpochEnv, os.Getenv(sourceDateEpochEnv))
+	os.Setenv(sourceDateEpochEnv, "1600000000")
+	testCases := []struct {
+		typ      string
+		expected map[interface{}]interface{}
+		err      string
+	}{
+		{typ: "lu32", expected: map[interface{}]interface{}{"lu32": 1600000000}},
+		{typ: "2006-01-02", expected: map[interface{}]interface{}{"s": "2020-09-13"}},
+		{typ: "built 15:04", expected: map[interface{}]interface{}{"s": "built 12:26"}},
+		{typ: "lu16", err: "invalid timestamp type lu16"},
+		{typ: "u8", err: "invalid timestamp type u8"},
+		{typ: "bi32", err: "invalid timestamp type bi32"},
+		{typ: "version", err: "doesn't contain any time fields"},
+	}
+	for _, tc := range testCases {
+		v, err := timestampValue(tc.typ)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expecting error %q, got %v", tc.typ, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.typ, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, tc.expected) {
+			t.Errorf("%s: expecting %v, got %v", tc.typ, tc.expected, v)
+		}
+	}
+}
+
+func TestResolveComputed(t *testing.T) {
+	c, err := testCharBinaryData(t, "metadata: [{s: 'h'}, {lcrc32: 0-1}, {sha256: {chars: '0,1', bytes: 2}}]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chr, err := c.Char()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := testCharBinaryData(t, "data: [{s: 'x'}]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherChr, err := other.Char()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chars := charMap{1: otherChr, 2: chr}
+	fs := newFontDataSet()
+	fs.dataSet[2] = c
+	if err := fs.ResolveComputed(chars, mcm.CharNum); err != nil {
+		t.Fatal(err)
+	}
+	data := append(blankChar().Data(), otherChr.Data()...)
+	meta := chars[2].Metadata()
+	expectedCRC := crc32.ChecksumIEEE(data)
+	if crc := binary.LittleEndian.Uint32(meta[1:]); crc != expectedCRC {
+		t.Errorf("expecting CRC 0x%08x, got 0x%08x", expectedCRC, crc)
+	}
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(meta[5:7], sum[:2]) {
+		t.Errorf("expecting SHA256 %x, got %x", sum[:2], meta[5:7])
+	}
+
+	// Character 1 depends on 2, which is resolved later
+	dep, err := testCharBinaryData(t, "metadata: [{bcrc16: 2}]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.dataSet[1] = dep
+	if err := fs.ResolveComputed(charMap{1: chr, 2: chr}, mcm.CharNum); err == nil || !strings.Contains(err.Error(), "unresolved computed fields") {
+		t.Errorf("expecting unresolved dependency error, got %v", err)
+	}
+}
+
+func TestStructTypes(t *testing.T) {
+	const types = `
+types:
+  offset:
+    - s: 'o'
+    - field: {name: x, type: i8}
+    - field: {name: y, type: i8, default: 0}
+  label:
+    - field: {name: text, type: s, size: 3}
+    - field: {name: pos, type: offset}
+`
+	testCases := []struct {
+		yaml     string
+		expected string
+		err      string
+	}{
+		{yaml: "offset: {x: 1, y: -1}", expected: "6f01ff"},
+		{yaml: "offset: {x: 2}", expected: "6f0200"},
+		{yaml: "label: {text: ab, pos: {x: 1, y: 2}}", expected: "6162006f0102"},
+		{yaml: "offset: {y: 2}", err: "missing field x"},
+		{yaml: "offset: {x: 1, z: 2}", err: "unknown fields [z]"},
+		{yaml: "offset: {x: 300}", err: "int8"},
+		{yaml: "offset: 3", err: "must be a map"},
+		{yaml: "label: {text: abcd, pos: {x: 1}}", err: "maximum is 3"},
+	}
+	for _, tc := range testCases {
+		raw := testDecodeYAMLMap(t, types+"1:\n  metadata: [{"+tc.yaml+"}]\n")
+		ef, err := splitExtraData(raw, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := newCharBinaryData()
+		err = c.Add(ef.Chars[1], &extraDataContext{Types: ef.Types})
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expecting error containing %q for %s, got %v", tc.err, tc.yaml, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error encoding %s: %v", tc.yaml, err)
+			continue
+		}
+		if h := hex.EncodeToString(c.Metadata); h != tc.expected {
+			t.Errorf("expecting %s for %s, got %s", tc.expected, tc.yaml, h)
+		}
+	}
+
+	invalid := []struct {
+		yaml string
+		err  string
+	}{
+		{yaml: "types: {u8: [{u8: 1}]}", err: "conflicts with a builtin type"},
+		{yaml: "types: {a: [{field: {name: x, type: b}}]}", err: "unknown type b"},
+		{yaml: "types: {a: [{field: {name: x, type: a}}]}", err: "includes itself"},
+		{yaml: "types: {a: [{field: {name: x, type: u8}}, {field: {name: x, type: u8}}]}", err: "duplicate field x"},
+		{yaml: "foo: 1", err: "without a symbol table"},
+		{yaml: "\"1-3\": {}\n\"2..4\": {}", err: "selected by both"},
+		{yaml: "\"1,2\": {payload: {data: [{u8: 1}]}}", err: "payloads must start"},
+	}
+	for _, tc := range invalid {
+		raw := testDecodeYAMLMap(t, tc.yaml)
+		if _, err := splitExtraData(raw, "", nil, nil); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expecting error containing %q for %s, got %v", tc.err, tc.yaml, err)
+		}
+	}
+}
+
+func TestPixelArt(t *testing.T) {
+	rows := []string{
+		"X#.g........",
+	}
+	for ii := 1; ii < mcm.CharHeight; ii++ {
+		rows = append(rows, "............")
+	}
+	quoted := func(rows []string) string {
+		return "['" + strings.Join(rows, "', '") + "']"
+	}
+	c, err := testCharBinaryData(t, "pixels: "+quoted(rows)+"\nmetadata: [{u8: 1}]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chr, err := c.Char()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []mcm.Pixel{mcm.PixelBlack, mcm.PixelWhite, mcm.PixelTransparent, mcm.PixelGray, mcm.PixelTransparent}
+	for x, p := range expected {
+		if px := chr.PixelAt(x, 0); px != p {
+			t.Errorf("expecting pixel %d at (%d, 0), got %d", p, x, px)
+		}
+	}
+	if meta := chr.Metadata(); meta[0] != 1 || meta[1] != mcmTransparentByte {
+		t.Errorf("unexpected metadata %x", meta)
+	}
+	if formatted := formatPixelArt(chr); !reflect.DeepEqual(formatted, rows) {
+		t.Errorf("expecting %v, got %v", rows, formatted)
+	}
+
+	invalid := append([]string(nil), rows...)
+	invalid[3] = "....Y......."
+	short := append([]string(nil), rows...)
+	short[5] = "..."
+	testCases := []struct {
+		yaml string
+		err  string
+	}{
+		{yaml: "pixels: " + quoted(invalid), err: "row 4, column 5: invalid symbol 'Y'"},
+		{yaml: "pixels: " + quoted(short), err: "row 6 has 3 columns"},
+		{yaml: "pixels: " + quoted(rows[1:]), err: "has 17 rows"},
+		{yaml: "pixels: " + quoted(rows) + "\ndata: [{u8: 1}]", err: "can't be combined with data"},
+	}
+	for _, tc := range testCases {
+		if _, err := testCharBinaryData(t, tc.yaml); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expecting error containing %q, got %v", tc.err, err)
+		}
+	}
+}
+
+func TestMergeModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, data string) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	base := write("base.yaml", "1:\n  metadata:\n    - u8: 1\n2:\n  metadata:\n    - u8: 2\n")
+	testCases := []struct {
+		yaml     string
+		mode     string
+		expected map[int]string
+		err      string
+	}{
+		{yaml: "1: {metadata: [{u8: 3}]}", expected: map[int]string{1: "0103", 2: "02"}},
+		{yaml: "1: {metadata: [{u8: 3}]}", mode: mergeReplace, expected: map[int]string{1: "03", 2: "02"}},
+		{yaml: "merge: replace\n1: {metadata: [{u8: 3}]}", expected: map[int]string{1: "03", 2: "02"}},
+		{yaml: "merge: replace\n1: {merge: append, metadata: [{u8: 3}]}", expected: map[int]string{1: "0103", 2: "02"}},
+		{yaml: "3: {metadata: [{u8: 3}]}", mode: mergeError, expected: map[int]string{1: "01", 2: "02", 3: "03"}},
+		{yaml: "merge: error\n2: {metadata: [{u8: 3}]}", err: "character 002 already has extra data from " + base},
+		{yaml: "merge: foo\n2: {metadata: [{u8: 3}]}", err: "invalid merge mode foo"},
+	}
+	for _, tc := range testCases {
+		fs := newFontDataSet()
+		fs.Merge = tc.mode
+		if err := fs.ParseFile(base); err != nil {
+			t.Fatal(err)
+		}
+		other := write("other.yaml", tc.yaml)
+		err := fs.ParseFile(other)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expecting error containing %q for %q, got %v", tc.err, tc.yaml, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error parsing %q: %v", tc.yaml, err)
+			continue
+		}
+		for k, v := range tc.expected {
+			if h := hex.EncodeToString(fs.Values()[k].Metadata); h != v {
+				t.Errorf("expecting %s in character %d for %q, got %s", v, k, tc.yaml, h)
+			}
+		}
+	}
+
+	// Replacing any character in a payload removes all of it
+	payload := write("payload.yaml", "10:\n  payload:\n    data:\n      - s: '"+strings.Repeat("x", 100)+"'\n")
+	for _, n := range []int{10, 11} {
+		fs := newFontDataSet()
+		if err := fs.ParseFile(payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.ParseFile(write("other.yaml", fmt.Sprintf("merge: replace\n%d: {metadata: [{u8: 3}]}", n))); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []int{10, 11} {
+			v := fs.Values()[k]
+			if k == n {
+				if v == nil || v.Payload >= 0 || hex.EncodeToString(v.Metadata) != "03" {
+					t.Errorf("expecting character %d to be replaced, got %+v", k, v)
+				}
+			} else if v != nil {
+				t.Errorf("expecting character %d to be removed after replacing %d, got %+v", k, n, v)
+			}
+		}
+	}
+
+	// Check the sources
+	fs := newFontDataSet()
+	if err := fs.ParseFile(base); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ParseFile(write("other.yaml", "\n1:\n  metadata:\n    - lu16: 3\n")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := fs.WriteReport(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("001 metadata [0, 1) from %s:3\n001 metadata [1, 3) from %s:4\n002 metadata [0, 1) from %s:6\n",
+		base, filepath.Join(dir, "other.yaml"), base)
+	if buf.String() != expected {
+		t.Errorf("expecting report:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
@@ -1,25 +1,46 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/fiam/max7456tool/mcm"
 
 	"github.com/urfave/cli/v2"
-	"gopkg.in/yaml.v2"
 )
 
 type generateFontConfig struct {
-	Source    string      `yaml:"source"`
-	ExtraData interface{} `yaml:"extra"`
-	Output    string      `yaml:"output"`
+	Source    string          `yaml:"source"`
+	ExtraData interface{}     `yaml:"extra"`
+	Output    string          `yaml:"output"`
+	Outline   *outlineOptions `yaml:"outline"`
+	// Outputs overrides the outputs in the global config
+	Outputs []*generateOutputConfig `yaml:"outputs"`
+
+	// dir is the directory of the config file declaring the
+	// font, used for relative paths. source and index point
+	// errors to the font in that file.
+	dir    string
+	source *yamlFile
+	index  int
 }
 
-func (c *generateFontConfig) ExtraDataFiles(dir string) ([]string, error) {
+// wrap returns an error pointing to the given path
+// inside the font in its config file
+func (c *generateFontConfig) wrap(err error, elems ...interface{}) error {
+	return c.source.Wrap(err, append([]interface{}{"fonts", c.index}, elems...)...)
+}
+
+func (c *generateFontConfig) ExtraDataFiles() ([]string, error) {
+	dir := c.dir
 	var files []string
 	switch x := c.ExtraData.(type) {
 	case []interface{}:
@@ -42,6 +63,8 @@ func (c *generateFontConfig) ExtraDataFiles(dir string) ([]string, error) {
 			nonExt := c.Source[:len(c.Source)-len(ext)]
 			files = append(files, filepath.Join(dir, nonExt+".yaml"))
 		}
+	case nil:
+		// No extra data
 	default:
 		return nil, fmt.Errorf("can't specify extra data files as %T = %v", x, x)
 	}
@@ -53,17 +76,62 @@ type generateConfig struct {
 	ExtraData   []string              `yaml:"extra"`
 	DefaultFont string                `yaml:"default"`
 	Fonts       []*generateFontConfig `yaml:"fonts"`
-	Dir         string                `yaml:"-"`
+	// Outputs are the outputs for fonts that don't declare theirs.
+	// If empty, an .mcm is generated, plus a .png if Previews is true.
+	Outputs []*generateOutputConfig `yaml:"outputs"`
+	// Include and Vars are handled by configLoader
+	Include []string          `yaml:"include"`
+	Vars    map[string]string `yaml:"vars"`
+	// Dir is the directory of the main config file
+	Dir string `yaml:"-"`
+
+	// These are filled while merging the included files and
+	// used to point errors to their position
+	extraFiles    []*configExtraFile
+	defaultSource *yamlFile
+	outputsSource *yamlFile
+}
+
+// configExtraFile is a global extra data file, with the
+// config file declaring it
+type configExtraFile struct {
+	Path   string
+	source *yamlFile
+	index  int
 }
 
 func (c *generateConfig) ExtraDataFiles() []string {
-	files := make([]string, len(c.ExtraData))
-	for ii, v := range c.ExtraData {
-		files[ii] = filepath.Join(c.Dir, v)
+	files := make([]string, len(c.extraFiles))
+	for ii, v := range c.extraFiles {
+		files[ii] = v.Path
 	}
 	return files
 }
 
+// FontOutputs returns the outputs for the given font, with
+// their paths resolved
+func (c *generateConfig) FontOutputs(font *generateFontConfig) []*fontOutput {
+	configs := font.Outputs
+	if len(configs) == 0 {
+		configs = c.Outputs
+	}
+	if len(configs) == 0 {
+		configs = []*generateOutputConfig{{Format: outputMCM}}
+		if c.Previews {
+			configs = append(configs, &generateOutputConfig{Format: outputPNG})
+		}
+	}
+	outputs := make([]*fontOutput, len(configs))
+	for ii, v := range configs {
+		outputs[ii] = &fontOutput{
+			Config: v,
+			Font:   font,
+			Path:   filepath.Join(font.dir, v.outputPath(font)),
+		}
+	}
+	return outputs
+}
+
 func (c *generateConfig) defaultFont() (*generateFontConfig, error) {
 	if c.DefaultFont != "" {
 		for _, v := range c.Fonts {
@@ -91,28 +159,39 @@ func (c *generateConfig) Parents(cfg *generateFontConfig) ([]*generateFontConfig
 	return parents, nil
 }
 
-func (c *generateConfig) Load(filename string) error {
-	data, err := ioutil.ReadFile(filename)
+// Load loads the config from filename and the files it includes,
+// using defines for the variables set via --define
+func (c *generateConfig) Load(filename string, defines map[string]string) error {
+	loader := &configLoader{Defines: defines}
+	f, err := loader.Load(filename, nil)
 	if err != nil {
-		return fmt.Errorf("error reading config file %s: %v", filename, err)
+		return err
 	}
-	if err := yaml.Unmarshal(data, c); err != nil {
+	if err := loader.Decode(f, f.AllVars(), c); err != nil {
 		return err
 	}
 	// Store filename's directory for relative paths
 	c.Dir = filepath.Dir(filename)
-	return c.validate()
+	if err := c.validate(); err != nil {
+		return fmt.Errorf("invalid config file: %v", err)
+	}
+	return nil
 }
 
 func (c *generateConfig) validate() error {
 	// Ensure all ExtraData files exist
-	for _, v := range c.ExtraDataFiles() {
-		st, err := os.Stat(v)
+	for _, v := range c.extraFiles {
+		st, err := os.Stat(v.Path)
 		if err != nil {
-			return fmt.Errorf("global extra data file %s is not readable: %v", v, err)
+			return v.source.Wrap(fmt.Errorf("global extra data file %s is not readable: %v", v.Path, err), "extra", v.index)
 		}
 		if st.IsDir() {
-			return fmt.Errorf("global extra data file %s is a directory, not a file", v)
+			return v.source.Wrap(fmt.Errorf("global extra data file %s is a directory, not a file", v.Path), "extra", v.index)
+		}
+	}
+	for ii, v := range c.Outputs {
+		if err := v.validate(); err != nil {
+			return c.outputsSource.Wrap(err, "outputs", ii)
 		}
 	}
 	// If default is non-empty, ensure it exists
@@ -126,88 +205,442 @@ func (c *generateConfig) validate() error {
 			}
 		}
 		if !found {
-			return fmt.Errorf("default font %q not found in the fonts list (%s)", c.DefaultFont, strings.Join(names, ", "))
+			return c.defaultSource.Wrap(fmt.Errorf("default font %q not found in the fonts list (%s)", c.DefaultFont, strings.Join(names, ", ")), "default")
 		}
 	}
 	// Ensure all input sources exist
-	for ii, v := range c.Fonts {
+	for _, v := range c.Fonts {
 		if v.Source == "" {
-			return fmt.Errorf("source %d is empty", ii+1)
+			return v.wrap(fmt.Errorf("source %d is empty", v.index+1), "source")
 		}
-		p := filepath.Join(c.Dir, v.Source)
+		p := filepath.Join(v.dir, v.Source)
 		if _, err := os.Stat(p); err != nil {
-			return fmt.Errorf("source %q (%q) doesn't exist: %v", v.Source, p, err)
+			return v.wrap(fmt.Errorf("source %q (%q) doesn't exist: %v", v.Source, p, err), "source")
+		}
+		if _, err := v.ExtraDataFiles(); err != nil {
+			return v.wrap(err, "extra")
+		}
+		if v.Outline != nil {
+			if _, err := v.Outline.Connectivity(); err != nil {
+				return v.wrap(err, "outline")
+			}
+		}
+		for jj, o := range v.Outputs {
+			if err := o.validate(); err != nil {
+				return v.wrap(err, "outputs", jj)
+			}
+		}
+	}
+	// Ensure no two outputs are written to the same file
+	paths := make(map[string]string)
+	for _, v := range c.Fonts {
+		for jj, o := range c.FontOutputs(v) {
+			if prev := paths[o.Path]; prev != "" {
+				return v.wrap(fmt.Errorf("output %s is also used by font %q", o.Path, prev), "outputs", jj)
+			}
+			paths[o.Path] = v.Source
 		}
 	}
 	return nil
 }
 
-func generateFont(ctx *cli.Context, globalFontData *fontDataSet, config *generateConfig,
-	font *generateFontConfig, opts *buildOptions, charMaps map[string]charMap) (charMap, error) {
+// matchFont returns true if the font matches the given glob,
+// either with or without its extension
+func matchFont(pattern string, font *generateFontConfig) (bool, error) {
+	names := []string{font.Source, strings.TrimSuffix(font.Source, filepath.Ext(font.Source))}
+	for _, name := range names {
+		ok, err := path.Match(pattern, name)
+		if err != nil {
+			return false, fmt.Errorf("invalid font pattern %q: %v", pattern, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
 
-	// Check if this font was already built due to
-	// being the parent of a previous font
-	if m := charMaps[font.Source]; m != nil {
-		return m, nil
+// splitFontPatterns splits the values of --only and --exclude,
+// which might contain several patterns separated by commas
+func splitFontPatterns(values []string) []string {
+	var patterns []string
+	for _, v := range values {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				patterns = append(patterns, p)
+			}
+		}
+	}
+	return patterns
+}
+
+// SelectFonts returns the fonts matching any of the globs in only
+// (or all of them if only is empty) and none of the ones in exclude.
+// Patterns which don't match any font are an error. Note that the
+// parents of the returned fonts are not included, see BuildOrder.
+func (c *generateConfig) SelectFonts(only []string, exclude []string) ([]*generateFontConfig, error) {
+	matches := func(patterns []string) (map[string]bool, error) {
+		matched := make(map[string]bool)
+		for _, p := range patterns {
+			found := false
+			for _, v := range c.Fonts {
+				ok, err := matchFont(p, v)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					matched[v.Source] = true
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("no font matches %q", p)
+			}
+		}
+		return matched, nil
 	}
-	var parentFonts []*namedFont
-	parents, err := config.Parents(font)
+	included, err := matches(only)
 	if err != nil {
 		return nil, err
 	}
-	for _, p := range parents {
-		pmcm := charMaps[p.Source]
-		if pmcm == nil {
-			// Must generate the parent first
-			if _, err := generateFont(ctx, globalFontData, config, p, opts, charMaps); err != nil {
-				return nil, err
+	excluded, err := matches(exclude)
+	if err != nil {
+		return nil, err
+	}
+	var fonts []*generateFontConfig
+	for _, v := range c.Fonts {
+		if (len(only) == 0 || included[v.Source]) && !excluded[v.Source] {
+			fonts = append(fonts, v)
+		}
+	}
+	if len(fonts) == 0 {
+		return nil, errors.New("no fonts selected")
+	}
+	return fonts, nil
+}
+
+// BuildOrder returns the given fonts in the order they should be built,
+// with each font preceded by its parents and otherwise in the same order
+// as in the config file. Parents are included even if they're not in
+// fonts. If fonts is nil, all the fonts in the config are returned.
+func (c *generateConfig) BuildOrder(fonts []*generateFontConfig) ([]*generateFontConfig, error) {
+	var order []*generateFontConfig
+	added := make(map[string]bool)
+	visiting := make(map[string]bool)
+	var visit func(font *generateFontConfig) error
+	visit = func(font *generateFontConfig) error {
+		if added[font.Source] {
+			return nil
+		}
+		if visiting[font.Source] {
+			return fmt.Errorf("font %q depends on itself", font.Source)
+		}
+		visiting[font.Source] = true
+		parents, err := c.Parents(font)
+		if err != nil {
+			return err
+		}
+		for _, p := range parents {
+			if err := visit(p); err != nil {
+				return err
 			}
-			pmcm = charMaps[p.Source]
-			if pmcm == nil {
-				panic(fmt.Errorf("generating font for %q didn't fill its charMap entry", p.Source))
+		}
+		visiting[font.Source] = false
+		added[font.Source] = true
+		order = append(order, font)
+		return nil
+	}
+	if fonts == nil {
+		fonts = c.Fonts
+	}
+	for _, v := range c.Fonts {
+		for _, f := range fonts {
+			if f == v {
+				if err := visit(v); err != nil {
+					return nil, err
+				}
 			}
 		}
-		parentFonts = append(parentFonts, &namedFont{Name: p.Source, Chars: pmcm})
 	}
+	return order, nil
+}
+
+// generator builds the fonts in a generateConfig
+type generator struct {
+	FontData *fontDataSet
+	Config   *generateConfig
+	Opts     *buildOptions
+	// Jobs is the number of fonts to build at the same time
+	Jobs int
+	// Cache, if non nil, is used to skip the fonts whose
+	// inputs didn't change since the last time
+	Cache *buildCache
+	// Check makes the generator build the fonts in memory and
+	// compare them with their existing outputs, recording the
+	// stale ones rather than writing them
+	Check bool
+	// Fonts are the fonts to build, plus their parents. If nil,
+	// all the fonts in Config are built.
+	Fonts []*generateFontConfig
 
-	logVerbose("generating font from %q", font.Source)
-	p := filepath.Join(config.Dir, font.Source)
-	ext := filepath.Ext(p)
-	nonExt := p[:len(p)-len(ext)]
-	fontData := globalFontData.Clone()
-	extraDataFiles, err := font.ExtraDataFiles(config.Dir)
+	mu    sync.Mutex
+	order []*generateFontConfig
+	stale []*staleFont
+}
+
+// Font builds the given font, whose parents must have been already
+// built. It might run concurrently with other fonts.
+func (g *generator) Font(font *generateFontConfig, parentFonts []*namedFont) (*namedFont, error) {
+	config := g.Config
+	log := newPrefixLogger(font.Source)
+	log.Verbose("generating font from %q", font.Source)
+	input := filepath.Join(font.dir, font.Source)
+	fontData := g.FontData.Clone()
+	fontData.Log = log
+	extraDataFiles, err := font.ExtraDataFiles()
 	if err != nil {
 		return nil, err
 	}
 	for _, f := range extraDataFiles {
-		logVerbose("parsing extra data from %q", f)
+		log.Verbose("parsing extra data from %q", f)
 		if err := fontData.ParseFile(f); err != nil {
 			return nil, err
 		}
 	}
-	var output string
-	if font.Output != "" {
-		output = filepath.Join(config.Dir, font.Output)
-	} else {
-		output = nonExt + ".mcm"
+	outputs := config.FontOutputs(font)
+	// Name used for messages and the data report
+	output := font.Source
+	for _, o := range outputs {
+		if o.Format() == outputMCM {
+			output = o.Path
+			break
+		}
+	}
+	fontOpts := *g.Opts
+	fontOpts.Log = log
+	if font.Outline != nil {
+		fontOpts.Outline = font.Outline
+	}
+	if g.Check {
+		// Never touch the sources when checking
+		fontOpts.RemoveDuplicates = nil
 	}
-	logVerbose("generating font %q from %q", output, p)
-	charMap, err := buildFromInput(output, p, fontData, parentFonts, opts)
+	var entry *fontCacheEntry
+	if g.Cache != nil && !g.Check {
+		if entry, err = newFontCacheEntry(input, fontData, parentFonts, &fontOpts, outputs); err != nil {
+			return nil, err
+		}
+		reason := g.Cache.RebuildReason(font.Source, entry, outputs)
+		if reason == "" && g.Opts.DataReport != nil {
+			reason = "--data-report was given"
+		}
+		if reason == "" && g.Opts.Provenance != nil {
+			reason = "--provenance was given"
+		}
+		if reason == "" && g.Opts.RemoveDuplicates != nil && g.Opts.RemoveDuplicates.DryRun {
+			reason = "--dry-run was given"
+		}
+		if reason == "" && output == font.Source {
+			reason = "it has no mcm output to load its characters from"
+		}
+		if reason == "" {
+			log.Verbose("skipping font %q, it's up to date", output)
+			chars, err := loadCachedFont(output)
+			if err != nil {
+				return nil, err
+			}
+			return &namedFont{Name: font.Source, Chars: chars, Hash: entry.Font}, nil
+		}
+		log.Verbose("rebuilding font %q: %s", output, reason)
+	}
+	log.Verbose("generating font %q from %q", output, input)
+	chars, enc, err := resolveFontFromInput(output, input, fontData, parentFonts, &fontOpts)
 	if err != nil {
 		return nil, err
 	}
-	if config.Previews {
-		pngOutput := nonExt + ".png"
-		logVerbose("generating preview image %q from %q", pngOutput, output)
-		if err := buildPNGFromMCM(ctx, pngOutput, output); err != nil {
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf); err != nil {
+		return nil, err
+	}
+	mcmData := buf.Bytes()
+	dec, err := mcm.NewDecoder(bytes.NewReader(mcmData))
+	if err != nil {
+		return nil, err
+	}
+	generated := &namedFont{Name: font.Source, Chars: chars, Hash: hashBytes(mcmData)}
+	if g.Check {
+		if err := g.checkOutputs(font, outputs, mcmData, dec, &fontOpts); err != nil {
+			return nil, err
+		}
+		return generated, nil
+	}
+	hashes := make(map[string]string, len(outputs))
+	for _, o := range outputs {
+		data, err := o.Render(mcmData, dec, &fontOpts)
+		if err != nil {
+			return nil, fmt.Errorf("error generating %s output %s: %v", o.Format(), o.Path, err)
+		}
+		log.Verbose("writing %s output %q", o.Format(), o.Path)
+		if err := writeOutputFile(o.Path, data); err != nil {
+			return nil, err
+		}
+		hashes[o.Path] = hashBytes(data)
+	}
+	if entry != nil {
+		if g.Opts.RemoveDuplicates != nil {
+			// Removing duplicates might have changed the sources
+			if entry.Source, err = hashFiles(input); err != nil {
+				return nil, err
+			}
+		}
+		entry.Font = generated.Hash
+		entry.Outputs = hashes
+		g.Cache.Set(font.Source, entry)
+	}
+	return generated, nil
+}
+
+// fontBuild tracks the state of a font while generating
+// several fonts in parallel
+type fontBuild struct {
+	Font    *generateFontConfig
+	Parents []*fontBuild
+	// done is closed once the build finishes, either
+	// successfully or not. font and err must not be
+	// accessed before that.
+	done chan struct{}
+	font *namedFont
+	err  error
+}
+
+// Order returns the fonts that Run builds, in order
+func (g *generator) Order() ([]*generateFontConfig, error) {
+	if g.order == nil {
+		order, err := g.Config.BuildOrder(g.Fonts)
+		if err != nil {
 			return nil, err
 		}
+		g.order = order
+	}
+	return g.order, nil
+}
+
+// PrintOrder writes the fonts that Run builds in order, marking
+// the ones which are only built because other fonts need them
+func (g *generator) PrintOrder(w io.Writer) error {
+	order, err := g.Order()
+	if err != nil {
+		return err
+	}
+	selected := make(map[*generateFontConfig]bool)
+	for _, v := range g.Fonts {
+		selected[v] = true
+	}
+	names := make([]string, len(order))
+	for ii, v := range order {
+		names[ii] = v.Source
+		if g.Fonts != nil && !selected[v] {
+			names[ii] += " (dependency)"
+		}
 	}
-	charMaps[font.Source] = charMap
-	return charMap, nil
+	_, err = fmt.Fprintf(w, "build order: %s\n", strings.Join(names, ", "))
+	return err
 }
 
-func generateAction(ctx *cli.Context) error {
+// Run builds all the fonts in the config, running up to g.Jobs
+// builds at the same time. Each font starts once all its parents
+// have been built. After the first error, no more builds are started
+// and the error is returned once the running ones finish.
+func (g *generator) Run() (map[string]charMap, error) {
+	order, err := g.Order()
+	if err != nil {
+		return nil, err
+	}
+	builds := make(map[string]*fontBuild, len(order))
+	for _, font := range order {
+		b := &fontBuild{Font: font, done: make(chan struct{})}
+		parents, err := g.Config.Parents(font)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range parents {
+			// BuildOrder guarantees parents come first
+			b.Parents = append(b.Parents, builds[p.Source])
+		}
+		builds[font.Source] = b
+	}
+	run := func(b *fontBuild) {
+		var parentFonts []*namedFont
+		for _, p := range b.Parents {
+			parentFonts = append(parentFonts, p.font)
+		}
+		b.font, b.err = g.Font(b.Font, parentFonts)
+	}
+	charMaps := make(map[string]charMap, len(order))
+	if g.Jobs <= 1 {
+		for _, font := range order {
+			b := builds[font.Source]
+			if run(b); b.err != nil {
+				return nil, b.err
+			}
+			charMaps[font.Source] = b.font.Chars
+		}
+		return charMaps, nil
+	}
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, g.Jobs)
+	abort := make(chan struct{})
+	for _, font := range order {
+		b := builds[font.Source]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(b.done)
+			for _, p := range b.Parents {
+				select {
+				case <-p.done:
+				case <-abort:
+					return
+				}
+				if p.err != nil {
+					return
+				}
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-abort:
+				return
+			}
+			defer func() { <-sem }()
+			select {
+			case <-abort:
+				return
+			default:
+			}
+			if run(b); b.err != nil {
+				once.Do(func() {
+					firstErr = b.err
+					close(abort)
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	for _, b := range builds {
+		charMaps[b.Font.Source] = b.font.Chars
+	}
+	return charMaps, nil
+}
+
+func generateAction(ctx *cli.Context) (err error) {
 	if ctx.NArg() != 1 {
 		return errors.New("generate requires 1 argument, see help generate")
 	}
@@ -215,25 +648,90 @@ func generateAction(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	jobs := ctx.Int("jobs")
+	if jobs < 1 {
+		return fmt.Errorf("invalid number of jobs %d, must be at least 1", jobs)
+	}
 	configFile := ctx.Args().Get(0)
 	var config generateConfig
-	if err := config.Load(configFile); err != nil {
+	if err := config.Load(configFile, opts.Defines); err != nil {
 		return err
 	}
+	if ctx.Bool("remove-duplicates") {
+		opts.RemoveDuplicates = newDuplicateRemover(config.Dir, ctx.String("backup-dir"), ctx.Bool("dry-run"))
+	} else if ctx.Bool("dry-run") {
+		return errors.New("--dry-run requires --remove-duplicates")
+	}
+	if report := ctx.String("data-report"); report != "" {
+		var f *os.File
+		if f, err = openOutputFile(report); err != nil {
+			return err
+		}
+		defer closeOutputFile(f, &err)
+		opts.DataReport = f
+	}
+	if provenance := ctx.String("provenance"); provenance != "" {
+		var f *os.File
+		if f, err = openOutputFile(provenance); err != nil {
+			return err
+		}
+		// Closed after the report is written, before returning
+		defer closeOutputFile(f, &err)
+		opts.Provenance = newProvenanceReport(f)
+	}
 	globalFontData := newFontDataSet()
+	globalFontData.Defines = opts.Defines
+	globalFontData.Merge = opts.Merge
 	for _, c := range config.ExtraDataFiles() {
 		logVerbose("parsing global extra data from %q", c)
 		if err := globalFontData.ParseFile(c); err != nil {
 			return err
 		}
 	}
-	charMaps := make(map[string]charMap)
-	for _, v := range config.Fonts {
-		mcm, err := generateFont(ctx, globalFontData, &config, v, opts, charMaps)
-		if err != nil {
+	g := &generator{
+		FontData: globalFontData,
+		Config:   &config,
+		Opts:     opts,
+		Jobs:     jobs,
+		Check:    ctx.Bool("check"),
+	}
+	only, exclude := splitFontPatterns(ctx.StringSlice("only")), splitFontPatterns(ctx.StringSlice("exclude"))
+	if len(only) > 0 || len(exclude) > 0 {
+		if g.Fonts, err = config.SelectFonts(only, exclude); err != nil {
+			return err
+		}
+		if err := g.PrintOrder(os.Stdout); err != nil {
 			return err
 		}
-		charMaps[v.Source] = mcm
 	}
-	return nil
+	if g.Check {
+		if _, err := g.Run(); err != nil {
+			return err
+		}
+		if err := opts.Provenance.Write(); err != nil {
+			return err
+		}
+		return g.ReportStale(os.Stdout)
+	}
+	if !ctx.Bool("no-cache") {
+		cacheFile := ctx.String("cache")
+		if cacheFile == "" {
+			if cacheFile, err = defaultCacheFile(configFile); err != nil {
+				return fmt.Errorf("error loading cache: %v", err)
+			}
+		}
+		if g.Cache, err = loadBuildCache(cacheFile); err != nil {
+			return fmt.Errorf("error loading cache: %v", err)
+		}
+		g.Cache.Rebuild = ctx.Bool("rebuild")
+	}
+	_, err = g.Run()
+	// Save the fonts built before any error too
+	if cerr := g.Cache.Save(); cerr != nil && err == nil {
+		err = fmt.Errorf("error saving cache: %v", cerr)
+	}
+	if err == nil {
+		err = opts.Provenance.Write()
+	}
+	return err
 }
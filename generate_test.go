@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiam/max7456tool/mcm"
+)
+
+func whitePNG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, mcm.CharWidth, mcm.CharHeight))
+	for x := 0; x < mcm.CharWidth; x++ {
+		for y := 0; y < mcm.CharHeight; y++ {
+			img.Set(x, y, mcm.WhiteColor)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testGenerateConfig(t *testing.T, dir string, config string, files map[string]string) *generateConfig {
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"default", "bold", "large", "small"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filename := filepath.Join(dir, "fonts.yaml")
+	if err := ioutil.WriteFile(filename, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var c generateConfig
+	if err := c.Load(filename, nil); err != nil {
+		t.Fatal(err)
+	}
+	return &c
+}
+
+const testGenerateFonts = `
+default: default
+fonts:
+  - source: bold
+  - source: default
+    extra: true
+  - source: large
+  - source: small
+`
+
+func TestBuildOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testGenerateConfig(t, dir, testGenerateFonts, map[string]string{"default.yaml": "{}"})
+	order, err := config.BuildOrder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range order {
+		names = append(names, v.Source)
+	}
+	if s := strings.Join(names, ","); s != "default,bold,large,small" {
+		t.Errorf("expecting build order default,bold,large,small, got %s", s)
+	}
+}
+
+func TestGenerateFontsParallel(t *testing.T) {
+	for _, jobs := range []int{1, 4} {
+		dir, err := ioutil.TempDir("", "max7456tool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		config := testGenerateConfig(t, dir, testGenerateFonts, map[string]string{
+			"default.yaml": "10: {metadata: [{u8: 1}]}",
+		})
+		fontData := newFontDataSet()
+		charMaps, err := (&generator{FontData: fontData, Config: config, Opts: &buildOptions{}, Jobs: jobs}).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"default", "bold", "large", "small"} {
+			chars := charMaps[name]
+			if chars == nil {
+				t.Fatalf("jobs = %d: font %s was not generated", jobs, name)
+			}
+			// Character 10 comes from the extra data in the default font
+			if data := chars[10].Data(); len(data) < 55 || data[54] != 1 {
+				t.Errorf("jobs = %d: font %s didn't get character 010 from its parent", jobs, name)
+			}
+			if _, err := os.Stat(filepath.Join(dir, name+".mcm")); err != nil {
+				t.Errorf("jobs = %d: %v", jobs, err)
+			}
+		}
+	}
+}
+
+func TestGenerateFontsError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testGenerateConfig(t, dir, testGenerateFonts, map[string]string{
+		"default.yaml": "10: {metadata: [{unknown: 1}]}",
+	})
+	_, err = (&generator{FontData: newFontDataSet(), Config: config, Opts: &buildOptions{}, Jobs: 4}).Run()
+	if err == nil || !strings.Contains(err.Error(), "default.yaml") {
+		t.Fatalf("expecting an error in default.yaml, got %v", err)
+	}
+	// No font depending on the default one should have been built
+	for _, name := range []string{"default", "bold", "large", "small"} {
+		if _, err := os.Stat(filepath.Join(dir, name+".mcm")); err == nil {
+			t.Errorf("font %s was generated after an error", name)
+		}
+	}
+}
+
+func TestDefaultCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, env := range []string{"XDG_CACHE_HOME", "HOME", "LocalAppData"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Setenv(env, dir)
+	}
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := defaultCacheFile(filepath.Join("fonts", "fonts.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first, filepath.Join(userCacheDir, cacheDirName)+string(filepath.Separator)) {
+		t.Errorf("expecting the cache in %s, got %s", userCacheDir, first)
+	}
+	if again, _ := defaultCacheFile(filepath.Join("fonts", "fonts.yaml")); again != first {
+		t.Errorf("expecting the same cache for the same config, got %s and %s", first, again)
+	}
+	if other, _ := defaultCacheFile(filepath.Join("fonts", "other.yaml")); other == first {
+		t.Errorf("expecting different caches for different configs, got %s", other)
+	}
+}
+
+func TestGenerateFontsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevForce := forceFlag
+	forceFlag = true
+	defer func() { forceFlag = prevForce }()
+	config := testGenerateConfig(t, dir, testGenerateFonts, map[string]string{
+		"default.yaml": "10: {metadata: [{u8: 1}]}",
+	})
+	// The directory for the cache is created when saving it
+	cacheFile := filepath.Join(dir, "cache", "fonts.json")
+	generate := func() {
+		cache, err := loadBuildCache(cacheFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (&generator{FontData: newFontDataSet(), Config: config, Opts: &buildOptions{}, Jobs: 2, Cache: cache}).Run(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Mark the outputs as old, so we can tell which ones were rebuilt
+	old := time.Now().Add(-time.Hour)
+	rebuilt := func() []string {
+		var names []string
+		for _, name := range []string{"default", "bold", "large", "small"} {
+			p := filepath.Join(dir, name+".mcm")
+			st, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.ModTime().After(old) {
+				names = append(names, name)
+			}
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return names
+	}
+	generate()
+	if s := strings.Join(rebuilt(), ","); s != "default,bold,large,small" {
+		t.Errorf("expecting all fonts to be built, got %s", s)
+	}
+	generate()
+	if s := strings.Join(rebuilt(), ","); s != "" {
+		t.Errorf("expecting no fonts to be rebuilt, got %s", s)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "small", "001.png"), whitePNG(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	generate()
+	if s := strings.Join(rebuilt(), ","); s != "small" {
+		t.Errorf("expecting small to be rebuilt, got %s", s)
+	}
+	// Changing the parent rebuilds its children
+	if err := ioutil.WriteFile(filepath.Join(dir, "default.yaml"), []byte("10: {metadata: [{u8: 2}]}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	generate()
+	if s := strings.Join(rebuilt(), ","); s != "default,bold,large,small" {
+		t.Errorf("expecting all fonts to be rebuilt, got %s", s)
+	}
+}
+
+func TestGenerateCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testGenerateConfig(t, dir, testGenerateFonts, map[string]string{
+		"default.yaml": "10: {metadata: [{u8: 1}]}",
+	})
+	if _, err := (&generator{FontData: newFontDataSet(), Config: config, Opts: &buildOptions{}}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	check := func() *generator {
+		g := &generator{FontData: newFontDataSet(), Config: config, Opts: &buildOptions{}, Jobs: 2, Check: true}
+		if _, err := g.Run(); err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+	if g := check(); len(g.stale) != 0 {
+		t.Fatalf("expecting no stale fonts, got %v", g.stale)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "default.yaml"), []byte("10: {metadata: [{u8: 2}]}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "small.mcm")); err != nil {
+		t.Fatal(err)
+	}
+	g := check()
+	var buf bytes.Buffer
+	if err := g.ReportStale(&buf); err == nil {
+		t.Error("expecting an error with stale fonts")
+	}
+	expected := []string{
+		"bold: " + filepath.Join(dir, "bold.mcm") + " has 1 changed characters: 010",
+		"default: " + filepath.Join(dir, "default.mcm") + " has 1 changed characters: 010",
+		"large: " + filepath.Join(dir, "large.mcm") + " has 1 changed characters: 010",
+		"small: " + filepath.Join(dir, "small.mcm") + " is missing",
+	}
+	if s := strings.TrimSpace(buf.String()); s != strings.Join(expected, "\n") {
+		t.Errorf("expecting report\n%s\ngot\n%s", strings.Join(expected, "\n"), s)
+	}
+	// Checking must not write anything
+	if _, err := os.Stat(filepath.Join(dir, "small.mcm")); err == nil {
+		t.Error("check wrote small.mcm")
+	}
+}
+
+func TestGenerateOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testGenerateConfig(t, dir, `
+outputs:
+  - mcm
+  - {format: bin, path: "fw/{name}.bin", flip: true}
+fonts:
+  - source: default
+  - source: bold
+    outputs:
+      - {format: c-header, path: "{name}_font.h", name: bold_font}
+      - text
+`, map[string]string{"default/001.png": string(whitePNG(t))})
+	if _, err := (&generator{FontData: newFontDataSet(), Config: config, Opts: &buildOptions{}}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	bin, err := ioutil.ReadFile(filepath.Join(dir, "fw", "default.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bin) != 256*mcm.CharBytes {
+		t.Fatalf("expecting %d bytes in bin, got %d", 256*mcm.CharBytes, len(bin))
+	}
+	// White is 10 in each pixel, flipping doesn't change it
+	if b := bin[mcm.CharBytes]; b != 0xaa {
+		t.Errorf("expecting white pixels in character 001, got %02x", b)
+	}
+	header, err := ioutil.ReadFile(filepath.Join(dir, "bold_font.h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(header), "static const uint8_t bold_font[BOLD_FONT_CHAR_COUNT][BOLD_FONT_CHAR_BYTES] = {") {
+		t.Errorf("unexpected C header:\n%s", header)
+	}
+	text, err := ioutil.ReadFile(filepath.Join(dir, "bold.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(text), "000\n............\n") {
+		t.Errorf("unexpected text output:\n%s", text)
+	}
+	for _, name := range []string{"bold.mcm", "default.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s should not have been generated", name)
+		}
+	}
+
+	for _, tc := range []struct{ outputs, err string }{
+		{"[{format: gif}]", "unknown output format"},
+		{"[{format: bin, scale: 2}]", "scale can only be used with hd"},
+		{"[{format: c-header, name: 1font}]", "not a valid C identifier"},
+		{"[{format: mcm, path: '{dir}/x.mcm'}]", "unknown variable {dir}"},
+		{"[{format: mcm, path: same.mcm}, {format: bin, path: same.mcm}]", "is also used"},
+	} {
+		filename := filepath.Join(dir, "bad.yaml")
+		if err := ioutil.WriteFile(filename, []byte("fonts: [{source: default, outputs: "+tc.outputs+"}]"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var c generateConfig
+		if err := c.Load(filename, nil); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expecting error %q, got %v", tc.outputs, tc.err, err)
+		}
+	}
+}
+
+func TestSelectFonts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testGenerateConfig(t, dir, testGenerateFonts, map[string]string{"default.yaml": "{}"})
+	testCases := []struct {
+		only, exclude string
+		order         string
+		err           string
+	}{
+		{only: "bold", order: "default (dependency), bold"},
+		{only: "bold,l*", order: "default (dependency), bold, large"},
+		{only: "default", order: "default"},
+		{exclude: "default", order: "default (dependency), bold, large, small"},
+		{exclude: "bold, small", order: "default, large"},
+		{only: "*", exclude: "*", err: "no fonts selected"},
+		{only: "italic", err: "no font matches \"italic\""},
+		{exclude: "[", err: "invalid font pattern"},
+	}
+	for _, tc := range testCases {
+		fonts, err := config.SelectFonts(splitFontPatterns([]string{tc.only}), splitFontPatterns([]string{tc.exclude}))
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("only %q, exclude %q: expecting error %q, got %v", tc.only, tc.exclude, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("only %q, exclude %q: %v", tc.only, tc.exclude, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := (&generator{Config: config, Fonts: fonts}).PrintOrder(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if s := buf.String(); s != "build order: "+tc.order+"\n" {
+			t.Errorf("only %q, exclude %q: expecting order %s, got %s", tc.only, tc.exclude, tc.order, s)
+		}
+	}
+}
+
+func TestGenerateInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, data string) string {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	for _, name := range []string{"common/default", "common/bold", "large"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("common/fonts.yaml", `
+vars:
+  SUFFIX: common
+default: default
+fonts:
+  - source: default
+  - source: bold
+    output: bold-${SUFFIX}.mcm
+`)
+	filename := write("fonts.yaml", `
+include:
+  - ${COMMON}/fonts.yaml
+vars:
+  COMMON: common
+  SUFFIX: main
+fonts:
+  - source: large
+    output: large-${MAX7456TOOL_TEST_VAR}-$${literal}.mcm
+`)
+	// Variables missing from vars come from the environment, but
+	// vars take precedence over it
+	os.Setenv("MAX7456TOOL_TEST_VAR", "env")
+	defer os.Unsetenv("MAX7456TOOL_TEST_VAR")
+	defer os.Setenv("SUFFIX", os.Getenv("SUFFIX"))
+	os.Setenv("SUFFIX", "env")
+
+	var c generateConfig
+	if err := c.Load(filename, nil); err != nil {
+		t.Fatal(err)
+	}
+	var outputs []string
+	for _, v := range c.Fonts {
+		outputs = append(outputs, c.FontOutputs(v)[0].Path)
+	}
+	expected := []string{
+		filepath.Join(dir, "common", "default.mcm"),
+		filepath.Join(dir, "common", "bold-main.mcm"),
+		filepath.Join(dir, "large-env-${literal}.mcm"),
+	}
+	if strings.Join(outputs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expecting outputs %v, got %v", expected, outputs)
+	}
+
+	// --define takes precedence over vars and the environment
+	c = generateConfig{}
+	if err := c.Load(filename, map[string]string{"SUFFIX": "defined", "MAX7456TOOL_TEST_VAR": "defined"}); err != nil {
+		t.Fatal(err)
+	}
+	if p := c.FontOutputs(c.Fonts[1])[0].Path; p != filepath.Join(dir, "common", "bold-defined.mcm") {
+		t.Errorf("unexpected output with --define %s", p)
+	}
+	if p := c.FontOutputs(c.Fonts[2])[0].Path; p != filepath.Join(dir, "large-defined-${literal}.mcm") {
+		t.Errorf("unexpected output with --define %s", p)
+	}
+
+	// Overriding a font from an included file
+	overrides := write("override.yaml", `
+include: [common/fonts.yaml]
+fonts:
+  - source: common/bold
+    output: bold-override.mcm
+`)
+	c = generateConfig{}
+	if err := c.Load(overrides, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Fonts) != 2 {
+		t.Fatalf("expecting 2 fonts, got %d", len(c.Fonts))
+	}
+	if p := c.FontOutputs(c.Fonts[1])[0].Path; p != filepath.Join(dir, "bold-override.mcm") {
+		t.Errorf("unexpected output for overridden font %s", p)
+	}
+
+	testCases := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"undefined.yaml", "fonts:\n  - source: large\n    output: ${UNDEFINED}.mcm\n", "undefined.yaml:3:5: undefined variable UNDEFINED"},
+		{"invalid.yaml", "fonts:\n  - source: ${1A}\n", "invalid variable name \"1A\""},
+		{"cycle.yaml", "include: [cycle2.yaml]\n", "include cycle"},
+		{"cycle2.yaml", "include: [cycle.yaml]\n", "include cycle"},
+		{"missing.yaml", "include: [nope.yaml]\n", "error reading config file"},
+	}
+	for _, tc := range testCases {
+		write(tc.name, tc.config)
+	}
+	for _, tc := range testCases {
+		c = generateConfig{}
+		err := c.Load(filepath.Join(dir, tc.name), nil)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expecting error %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestGenerateProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	white := string(whitePNG(t))
+	config := testGenerateConfig(t, dir, testGenerateFonts, map[string]string{
+		"default.yaml":    "10: {metadata: [{u8: 1}]}\n65: {metadata: [{u8: 2}]}\n",
+		"default/065.png": white,
+		"bold/066.png":    white,
+	})
+	var buf bytes.Buffer
+	opts := &buildOptions{Provenance: newProvenanceReport(&buf)}
+	g := &generator{FontData: newFontDataSet(), Config: config, Opts: opts, Jobs: 4}
+	if _, err := g.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.Provenance.Write(); err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Fonts []*fontProvenanceReport
+	}
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	fonts := make(map[string]*fontProvenanceReport)
+	for _, v := range report.Fonts {
+		fonts[filepath.Base(v.Font)] = v
+	}
+	if len(fonts) != 4 {
+		t.Fatalf("expecting 4 fonts, got %d", len(fonts))
+	}
+	def := fonts["default.mcm"].Chars
+	bold := fonts["bold.mcm"].Chars
+	if len(def) != 256 || len(bold) != 256 {
+		t.Fatalf("expecting 256 characters, got %d and %d", len(def), len(bold))
+	}
+	if c := def[10]; c.Source != originExtraData || c.MetadataMerged || len(c.ExtraData) != 1 || !strings.Contains(c.ExtraData[0], "default.yaml:1") {
+		t.Errorf("unexpected provenance for 010 in default: %+v", c)
+	}
+	if c := def[65]; c.Source != originImage || !c.MetadataMerged || filepath.Base(c.File) != "065.png" || c.Cell == nil {
+		t.Errorf("unexpected provenance for 065 in default: %+v", c)
+	}
+	if c := def[66]; c.Source != originBlank {
+		t.Errorf("unexpected provenance for 066 in default: %+v", c)
+	}
+	if c := bold[65]; c.Source != originParent || c.Parent != "default" || c.Hash != def[65].Hash {
+		t.Errorf("unexpected provenance for 065 in bold: %+v", c)
+	}
+	if c := bold[66]; c.Source != originImage || filepath.Base(c.File) != "066.png" || c.Hash == def[65].Hash {
+		t.Errorf("unexpected provenance for 066 in bold: %+v", c)
+	}
+}
+
+func TestGenerateRemoveDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevForce := forceFlag
+	forceFlag = true
+	defer func() { forceFlag = prevForce }()
+	white, err := png.Decode(bytes.NewReader(whitePNG(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 065 is equal to the parent, 066 is black
+	combined := image.NewRGBA(image.Rect(0, 0, mcm.CharWidth*2, mcm.CharHeight))
+	draw.Draw(combined, combined.Bounds(), image.NewUniform(mcm.BlackColor), image.ZP, draw.Src)
+	draw.Draw(combined, white.Bounds(), white, image.ZP, draw.Src)
+	combinedData, err := encodePNG(combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sheet with 065 and 066, like the one in combined
+	chars := make(charMap)
+	for ii := 0; ii < 2; ii++ {
+		if chars[65+ii], err = mcm.NewCharFromImage(combined, ii*mcm.CharWidth, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mcmData bytes.Buffer
+	if err := (&mcm.Encoder{Chars: chars, Fill: true}).Encode(&mcmData); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := mcm.NewDecoder(&mcmData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheetData, err := encodePNG(mcmImage(dec, defaultColumns, defaultMargin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"default/065.png":   string(whitePNG(t)),
+		"bold/065.png":      string(whitePNG(t)),
+		"large/065_066.png": string(combinedData),
+		"small.png":         string(sheetData),
+	}
+	fonts := "default: default\nfonts:\n  - source: default\n  - source: bold\n  - source: large\n  - source: small.png\n"
+	config := testGenerateConfig(t, dir, fonts, files)
+	run := func(remover *duplicateRemover) map[string]charMap {
+		opts := &buildOptions{Margin: defaultMargin, Columns: defaultColumns, RemoveDuplicates: remover}
+		charMaps, err := (&generator{FontData: newFontDataSet(), Config: config, Opts: opts}).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return charMaps
+	}
+	var out bytes.Buffer
+	remover := newDuplicateRemover(dir, "", true)
+	remover.Out = &out
+	before := run(remover)
+	for name, data := range files {
+		if current, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(current) != data {
+			t.Errorf("--dry-run changed %s", name)
+		}
+	}
+	for _, expected := range []string{
+		"[bold] would remove " + filepath.Join("bold", "065.png") + ": 065 (equal to default)",
+		"[large] would split " + filepath.Join("large", "065_066.png") + " into 066.png: 065 (equal to default)",
+		"[small.png] would clear 1 cells in small.png: 065 (equal to default)",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expecting %q in the --dry-run output, got %q", expected, out.String())
+		}
+	}
+
+	remover = newDuplicateRemover(dir, filepath.Join(dir, "backup"), false)
+	after := run(remover)
+	for _, name := range []string{"bold/065.png", "large/065_066.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	for name, data := range files {
+		if name == "default/065.png" {
+			continue
+		}
+		backup, err := ioutil.ReadFile(filepath.Join(remover.BackupDir, name))
+		if err != nil || string(backup) != data {
+			t.Errorf("%s was not moved to the backup directory: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "large", "066.png")); err != nil {
+		t.Errorf("066 was not split from large/065_066.png: %v", err)
+	}
+	// The fonts must stay the same
+	for font, chars := range before {
+		for ii := 0; ii < mcm.CharNum; ii++ {
+			if (chars[ii] == nil) != (after[font][ii] == nil) || (chars[ii] != nil && !chars[ii].Equal(after[font][ii])) {
+				t.Errorf("character %03d in %s changed after removing duplicates", ii, font)
+			}
+		}
+	}
+	// Nothing else to remove
+	out.Reset()
+	remover = newDuplicateRemover(dir, "", true)
+	remover.Out = &out
+	run(remover)
+	if out.Len() > 0 {
+		t.Errorf("unexpected duplicates after removing them: %s", out.String())
+	}
+}
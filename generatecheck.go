@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/fiam/max7456tool/mcm"
+)
+
+// staleFont is a font whose outputs don't match the result
+// of building it, found by generate --check
+type staleFont struct {
+	Font string
+	// Problems contains a description for each stale output
+	Problems []string
+}
+
+func (s *staleFont) String() string {
+	return fmt.Sprintf("%s: %s", s.Font, strings.Join(s.Problems, "; "))
+}
+
+func changedCharsProblem(output string, chars []int) string {
+	nums := make([]string, len(chars))
+	for ii, c := range chars {
+		nums[ii] = fmt.Sprintf("%03d", c)
+	}
+	return fmt.Sprintf("%s has %d changed characters: %s", output, len(chars), strings.Join(nums, ", "))
+}
+
+// checkOutputs compares the outputs of the font, built in memory,
+// with the existing files, recording the font as stale if any of
+// them differ.
+func (g *generator) checkOutputs(font *generateFontConfig, outputs []*fontOutput, mcmData []byte, dec *mcm.Decoder, opts *buildOptions) error {
+	stale := &staleFont{Font: font.Source}
+	for _, o := range outputs {
+		opts.Log.Verbose("checking %s output %q", o.Format(), o.Path)
+		data, err := o.Render(mcmData, dec, opts)
+		if err != nil {
+			return fmt.Errorf("error generating %s output %s: %v", o.Format(), o.Path, err)
+		}
+		if problem := compareOutput(o, data, dec); problem != "" {
+			stale.Problems = append(stale.Problems, problem)
+		}
+	}
+	if len(stale.Problems) > 0 {
+		opts.Log.Verbose("font %q is stale", font.Source)
+		g.mu.Lock()
+		g.stale = append(g.stale, stale)
+		g.mu.Unlock()
+	}
+	return nil
+}
+
+// compareOutput compares the existing file for the output o with
+// the expected data, returning a description of the problem if
+// they don't match.
+func compareOutput(o *fontOutput, data []byte, dec *mcm.Decoder) string {
+	existing, err := ioutil.ReadFile(o.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Sprintf("%s is missing", o.Path)
+		}
+		return fmt.Sprintf("%s is not readable: %v", o.Path, err)
+	}
+	if bytes.Equal(existing, data) {
+		return ""
+	}
+	switch o.Format() {
+	case outputMCM:
+		chars, problem := compareMCMOutput(existing, dec)
+		if problem != "" {
+			return fmt.Sprintf("%s %s", o.Path, problem)
+		}
+		return changedCharsProblem(o.Path, chars)
+	case outputPNG, outputHD:
+		// Compare the pixels, since the same image might
+		// be encoded differently
+		if problem := comparePNGOutput(existing, data); problem != "" {
+			return fmt.Sprintf("%s %s", o.Path, problem)
+		}
+		return ""
+	}
+	if size := o.CharSize(); size > 0 && len(existing) == len(data) {
+		var chars []int
+		for ii := 0; ii+size <= len(data); ii += size {
+			if !bytes.Equal(existing[ii:ii+size], data[ii:ii+size]) {
+				chars = append(chars, ii/size)
+			}
+		}
+		return changedCharsProblem(o.Path, chars)
+	}
+	return fmt.Sprintf("%s is out of date", o.Path)
+}
+
+// compareMCMOutput compares the existing .mcm data with the built
+// font, returning either the characters that changed or a problem
+// with the existing data.
+func compareMCMOutput(existing []byte, dec *mcm.Decoder) ([]int, string) {
+	prev, err := mcm.NewDecoder(bytes.NewReader(existing))
+	if err != nil {
+		return nil, fmt.Sprintf("is not a valid .mcm file: %v", err)
+	}
+	n := dec.NChars()
+	if prev.NChars() > n {
+		n = prev.NChars()
+	}
+	var changed []int
+	for ii := 0; ii < n; ii++ {
+		if ii >= dec.NChars() || ii >= prev.NChars() || !dec.CharAt(ii).Equal(prev.CharAt(ii)) {
+			changed = append(changed, ii)
+		}
+	}
+	if len(changed) == 0 {
+		// Same characters, but different encoding (e.g. line endings)
+		return nil, "has the same characters but it's encoded differently"
+	}
+	return changed, ""
+}
+
+// comparePNGOutput compares the pixels in the existing PNG
+// with the expected one, returning a description of the
+// problem if they differ.
+func comparePNGOutput(existing []byte, data []byte) string {
+	prev, err := png.Decode(bytes.NewReader(existing))
+	if err != nil {
+		return fmt.Sprintf("is not a valid PNG: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Sprintf("can't be compared: %v", err)
+	}
+	bounds := img.Bounds()
+	if prev.Bounds() != bounds {
+		return fmt.Sprintf("has size %dx%d, expecting %dx%d", prev.Bounds().Dx(), prev.Bounds().Dy(), bounds.Dx(), bounds.Dy())
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, a1 := img.At(x, y).RGBA()
+			r2, g2, b2, a2 := prev.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return "is out of date"
+			}
+		}
+	}
+	return ""
+}
+
+// ReportStale writes the stale fonts found by a check, in the same
+// order as the config file, returning an error if there are any.
+func (g *generator) ReportStale(w io.Writer) error {
+	if len(g.stale) == 0 {
+		logVerbose("all fonts are up to date")
+		return nil
+	}
+	for _, v := range g.Config.Fonts {
+		for _, s := range g.stale {
+			if s.Font == v.Source {
+				if _, err := fmt.Fprintln(w, s); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%d of %d fonts are out of date, run generate to update them", len(g.stale), len(g.order))
+}
@@ -4,5 +4,5 @@ go 1.14
 
 require (
 	github.com/urfave/cli/v2 v2.2.0
-	gopkg.in/yaml.v2 v2.2.2
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -4,14 +4,25 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+
+	"github.com/fiam/max7456tool/mcm"
 )
 
 var (
 	forceFlag = false
 )
 
+// outputFileMu serializes calls to openOutputFile, so only one
+// overwrite prompt is shown at a time when generating fonts in
+// parallel. It also protects forceFlag.
+var outputFileMu sync.Mutex
+
 func openOutputFile(filename string) (*os.File, error) {
+	outputFileMu.Lock()
+	defer outputFileMu.Unlock()
 	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
 	if !forceFlag {
 		flags |= os.O_EXCL
@@ -39,3 +50,51 @@ func openOutputFile(filename string) (*os.File, error) {
 	}
 	return f, nil
 }
+
+// writeOutputFile writes data to filename using openOutputFile,
+// creating its directory if needed
+func writeOutputFile(filename string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	f, err := openOutputFile(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// closeOutputFile closes f, storing the error in errp unless it
+// already contains another one. It's intended to be deferred for
+// files written during the whole run of a command, so errors closing
+// them aren't lost.
+func closeOutputFile(f *os.File, errp *error) {
+	if err := f.Close(); err != nil && *errp == nil {
+		*errp = err
+	}
+}
+
+func decodeMCMFile(filename string) (*mcm.Decoder, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec, err := mcm.NewDecoder(f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", filename, err)
+	}
+	return dec, nil
+}
+
+func decoderCharMap(dec *mcm.Decoder) charMap {
+	chars := make(charMap, dec.NChars())
+	for ii := 0; ii < dec.NChars(); ii++ {
+		chars[ii] = dec.CharAt(ii)
+	}
+	return chars
+}
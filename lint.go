@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/fiam/max7456tool/mcm"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	lintTargetMAX7456  = "max7456"
+	lintTargetFrSkyOSD = "frskyosd"
+)
+
+type lintSeverity int
+
+const (
+	lintOff lintSeverity = iota
+	lintInfo
+	lintWarning
+	lintError
+)
+
+func parseLintSeverity(s string) (lintSeverity, error) {
+	switch strings.ToLower(s) {
+	case "off":
+		return lintOff, nil
+	case "info":
+		return lintInfo, nil
+	case "warning":
+		return lintWarning, nil
+	case "error":
+		return lintError, nil
+	}
+	return lintOff, fmt.Errorf("invalid lint severity %q, must be off, info, warning or error", s)
+}
+
+func (s lintSeverity) String() string {
+	switch s {
+	case lintOff:
+		return "off"
+	case lintInfo:
+		return "info"
+	case lintWarning:
+		return "warning"
+	case lintError:
+		return "error"
+	}
+	return fmt.Sprintf("lintSeverity(%d)", int(s))
+}
+
+func (s lintSeverity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// lintRuleConfig configures a lint rule. In YAML, it can be
+// written either as just the severity or as a map:
+//
+//	missing-outline: error
+//	edge-touching:
+//	  severity: warning
+//	  chars: 0x20-0x7f
+type lintRuleConfig struct {
+	Severity string `yaml:"severity"`
+	Chars    string `yaml:"chars"`
+}
+
+func (c *lintRuleConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*c = lintRuleConfig{Severity: node.Value}
+		return nil
+	}
+	type plain lintRuleConfig
+	return node.Decode((*plain)(c))
+}
+
+type lintConfig struct {
+	Target string                     `yaml:"target"`
+	Rules  map[string]*lintRuleConfig `yaml:"rules"`
+}
+
+func (c *lintConfig) Load(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("error reading lint config file %s: %v", filename, err)
+	}
+	source, err := parseYAMLFile(filename, data)
+	if err != nil {
+		return fmt.Errorf("error parsing lint config file: %v", err)
+	}
+	if source.Root == nil {
+		return nil
+	}
+	if err := source.CheckKeys(c); err != nil {
+		return fmt.Errorf("error parsing lint config file: %v", err)
+	}
+	if err := source.Root.Decode(c); err != nil {
+		return fmt.Errorf("error parsing lint config file %s: %v", filename, err)
+	}
+	for name := range c.Rules {
+		if findLintRule(name) == nil {
+			return fmt.Errorf("unknown lint rule %q in %s", name, filename)
+		}
+	}
+	return nil
+}
+
+type lintIssue struct {
+	Rule     string       `json:"rule"`
+	Severity lintSeverity `json:"severity"`
+	Char     int          `json:"char"`
+	Message  string       `json:"message"`
+}
+
+type linter struct {
+	chars     []*mcm.Char
+	target    string
+	selection map[int]bool
+	rule      *lintRule
+	severity  lintSeverity
+	issues    []*lintIssue
+}
+
+// Selected returns true iff character n should be checked
+// by the rule that is currently running.
+func (l *linter) Selected(n int) bool {
+	return l.selection == nil || l.selection[n]
+}
+
+func (l *linter) Report(n int, format string, args ...interface{}) {
+	l.issues = append(l.issues, &lintIssue{
+		Rule:     l.rule.Name,
+		Severity: l.severity,
+		Char:     n,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+type lintRule struct {
+	Name     string
+	Severity lintSeverity
+	Usage    string
+	Check    func(l *linter)
+}
+
+var lintRules = []*lintRule{
+	{
+		Name:     "missing-outline",
+		Severity: lintWarning,
+		Usage:    "white pixels touching transparent ones",
+		Check:    lintMissingOutline,
+	},
+	{
+		Name:     "gray-pixels",
+		Severity: lintError,
+		Usage:    "gray pixels, which are shown as transparent by MAX7456 (only for the max7456 target)",
+		Check:    lintGrayPixels,
+	},
+	{
+		Name:     "digits",
+		Severity: lintWarning,
+		Usage:    "digits 0-9 with different widths or baselines",
+		Check:    lintDigits,
+	},
+	{
+		Name:     "edge-touching",
+		Severity: lintInfo,
+		Usage:    "white pixels in the left or right columns, which bleed into the neighbor characters",
+		Check:    lintEdgeTouching,
+	},
+	{
+		Name:     "duplicate",
+		Severity: lintInfo,
+		Usage:    "characters identical to a previous one",
+		Check:    lintDuplicate,
+	},
+	{
+		Name:     "blank-metadata",
+		Severity: lintWarning,
+		Usage:    "blank characters with metadata",
+		Check:    lintBlankMetadata,
+	},
+}
+
+func findLintRule(name string) *lintRule {
+	for _, r := range lintRules {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func lintMissingOutline(l *linter) {
+	for ii, chr := range l.chars {
+		if !l.Selected(ii) {
+			continue
+		}
+		if missing := mcm.MissingOutline(chr, mcm.Connectivity8); len(missing) > 0 {
+			l.Report(ii, "%d transparent pixels touching white ones, first at (%d,%d)",
+				len(missing), missing[0].X, missing[0].Y)
+		}
+	}
+}
+
+func lintGrayPixels(l *linter) {
+	if l.target != lintTargetMAX7456 {
+		return
+	}
+	for ii, chr := range l.chars {
+		if !l.Selected(ii) {
+			continue
+		}
+		count := 0
+		chr.ForEachPixel(func(x, y int, unused bool, p mcm.Pixel) {
+			if !unused && p == mcm.PixelGray {
+				count++
+			}
+		})
+		if count > 0 {
+			l.Report(ii, "%d gray pixels, shown as transparent by MAX7456", count)
+		}
+	}
+}
+
+// charExtent returns the horizontal extent of the non transparent pixels
+// in a character as well as the lowest row with a white pixel. If the
+// character has no visible pixels, ok is false.
+func charExtent(chr *mcm.Char) (width int, baseline int, ok bool) {
+	minX := mcm.CharWidth
+	maxX := -1
+	baseline = -1
+	chr.ForEachPixel(func(x, y int, unused bool, p mcm.Pixel) {
+		if unused || p == mcm.PixelTransparent {
+			return
+		}
+		if x < minX {
+			minX = x
+		}
+		if x > maxX {
+			maxX = x
+		}
+		if p == mcm.PixelWhite && y > baseline {
+			baseline = y
+		}
+	})
+	if maxX < 0 {
+		return 0, 0, false
+	}
+	return maxX - minX + 1, baseline, true
+}
+
+// mostCommon returns the most common value in m, resolving ties by
+// returning the lowest value.
+func mostCommon(m map[int]int) int {
+	best := -1
+	bestCount := 0
+	for v, c := range m {
+		if c > bestCount || (c == bestCount && v < best) {
+			best = v
+			bestCount = c
+		}
+	}
+	return best
+}
+
+func lintDigits(l *linter) {
+	widths := make(map[int]int)
+	baselines := make(map[int]int)
+	type extent struct{ width, baseline int }
+	extents := make(map[int]extent)
+	for ii := '0'; ii <= '9'; ii++ {
+		n := int(ii)
+		if n >= len(l.chars) || !l.Selected(n) {
+			continue
+		}
+		if w, b, ok := charExtent(l.chars[n]); ok {
+			widths[w]++
+			baselines[b]++
+			extents[n] = extent{w, b}
+		}
+	}
+	width := mostCommon(widths)
+	baseline := mostCommon(baselines)
+	for n := int('0'); n <= '9'; n++ {
+		e, found := extents[n]
+		if !found {
+			continue
+		}
+		if e.width != width {
+			l.Report(n, "digit %c has width %d, most digits have %d", rune(n), e.width, width)
+		}
+		if e.baseline != baseline {
+			l.Report(n, "digit %c has its baseline at row %d, most digits have it at %d", rune(n), e.baseline, baseline)
+		}
+	}
+}
+
+func lintEdgeTouching(l *linter) {
+	for ii, chr := range l.chars {
+		if !l.Selected(ii) {
+			continue
+		}
+		var sides []string
+		for _, x := range []int{0, mcm.CharWidth - 1} {
+			for y := 0; y < mcm.CharHeight; y++ {
+				if chr.PixelAt(x, y) == mcm.PixelWhite {
+					side := "left"
+					if x > 0 {
+						side = "right"
+					}
+					sides = append(sides, side)
+					break
+				}
+			}
+		}
+		switch len(sides) {
+		case 1:
+			l.Report(ii, "white pixels touching the %s edge", sides[0])
+		case 2:
+			l.Report(ii, "white pixels touching both edges")
+		}
+	}
+}
+
+func lintDuplicate(l *linter) {
+	for ii, chr := range l.chars {
+		if !l.Selected(ii) || chr.IsBlank() {
+			continue
+		}
+		for jj := 0; jj < ii; jj++ {
+			if l.chars[jj].VisibleEqual(chr) {
+				l.Report(ii, "identical to character %03d", jj)
+				break
+			}
+		}
+	}
+}
+
+func lintBlankMetadata(l *linter) {
+	for ii, chr := range l.chars {
+		if !l.Selected(ii) {
+			continue
+		}
+		// IsBlank also looks at the metadata, compare just
+		// the visible pixels
+		if !chr.MetadataIsBlank() && chr.VisibleEqual(blankChar()) {
+			l.Report(ii, "blank character has metadata %v", chr.Metadata())
+		}
+	}
+}
+
+func lintFont(dec *mcm.Decoder, config *lintConfig) ([]*lintIssue, error) {
+	l := &linter{
+		target: config.Target,
+	}
+	if l.target == "" {
+		l.target = lintTargetMAX7456
+	}
+	if l.target != lintTargetMAX7456 && l.target != lintTargetFrSkyOSD {
+		return nil, fmt.Errorf("invalid lint target %q, must be %s or %s", l.target, lintTargetMAX7456, lintTargetFrSkyOSD)
+	}
+	l.chars = decoderChars(dec)
+	for _, r := range lintRules {
+		l.rule = r
+		l.severity = r.Severity
+		l.selection = nil
+		if rc := config.Rules[r.Name]; rc != nil {
+			if rc.Severity != "" {
+				severity, err := parseLintSeverity(rc.Severity)
+				if err != nil {
+					return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+				}
+				l.severity = severity
+			}
+			if rc.Chars != "" {
+				selection, err := parseCharSelection(rc.Chars, dec.NChars())
+				if err != nil {
+					return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+				}
+				l.selection = make(map[int]bool, len(selection))
+				for _, n := range selection {
+					l.selection[n] = true
+				}
+			}
+		}
+		if l.severity == lintOff {
+			continue
+		}
+		logDebug("running lint rule %s with severity %v", r.Name, l.severity)
+		r.Check(l)
+	}
+	sort.SliceStable(l.issues, func(i, j int) bool {
+		return l.issues[i].Char < l.issues[j].Char
+	})
+	return l.issues, nil
+}
+
+func lintRulesUsage() string {
+	var lines []string
+	for _, r := range lintRules {
+		lines = append(lines, fmt.Sprintf("\t%s (%v): %s", r.Name, r.Severity, r.Usage))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func lintAction(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("lint requires 1 argument, see help lint")
+	}
+	var config lintConfig
+	if cfg := ctx.String("config"); cfg != "" {
+		if err := config.Load(cfg); err != nil {
+			return err
+		}
+	}
+	if target := ctx.String("target"); target != "" {
+		config.Target = target
+	}
+	failOn, err := parseLintSeverity(ctx.String("fail-on"))
+	if err != nil {
+		return err
+	}
+	input := ctx.Args().Get(0)
+	dec, err := decodeMCMFile(input)
+	if err != nil {
+		return err
+	}
+	issues, err := lintFont(dec, &config)
+	if err != nil {
+		return err
+	}
+	switch ctx.String("format") {
+	case "text":
+		for _, v := range issues {
+			fmt.Printf("%s: character %03d: %v: %s [%s]\n", input, v.Char, v.Severity, v.Message, v.Rule)
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if issues == nil {
+			issues = []*lintIssue{}
+		}
+		if err := enc.Encode(issues); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid output format %q, must be text or json", ctx.String("format"))
+	}
+	if failOn != lintOff {
+		failed := 0
+		for _, v := range issues {
+			if v.Severity >= failOn {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%s has %d lint issues with severity %v or higher", input, failed, failOn)
+		}
+	}
+	return nil
+}
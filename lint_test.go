@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/fiam/max7456tool/mcm"
+)
+
+// testBoxChar returns a character with a white box of the given size
+// at x0, y0, surrounded by black pixels if outline is true
+func testBoxChar(t *testing.T, x0, y0, w, h int, outline bool) *mcm.Char {
+	var pixels mcm.Pixels
+	for y := 0; y < mcm.CharHeight; y++ {
+		for x := 0; x < mcm.CharWidth; x++ {
+			switch {
+			case x >= x0 && x < x0+w && y >= y0 && y < y0+h:
+				pixels[y][x] = mcm.PixelWhite
+			case outline && x >= x0-1 && x <= x0+w && y >= y0-1 && y <= y0+h:
+				pixels[y][x] = mcm.PixelBlack
+			default:
+				pixels[y][x] = mcm.PixelTransparent
+			}
+		}
+	}
+	chr, err := mcm.NewCharFromPixels(&pixels, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chr
+}
+
+func testLintDecoder(t *testing.T, chars charMap) *mcm.Decoder {
+	var buf bytes.Buffer
+	if err := (&mcm.Encoder{Chars: chars, Fill: true}).Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := mcm.NewDecoder(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dec
+}
+
+func testDigits(t *testing.T, narrow int) charMap {
+	chars := make(charMap)
+	for ii := '0'; ii <= '9'; ii++ {
+		w := 6
+		if int(ii) == narrow {
+			w = 4
+		}
+		chars[int(ii)] = testBoxChar(t, 3, 4, w, 10, true)
+	}
+	return chars
+}
+
+func TestLintRules(t *testing.T) {
+	grayChar := func(t *testing.T) *mcm.Char {
+		var pixels mcm.Pixels
+		for y := range pixels {
+			for x := range pixels[y] {
+				pixels[y][x] = mcm.PixelTransparent
+			}
+		}
+		pixels[5][5] = mcm.PixelGray
+		chr, err := mcm.NewCharFromPixels(&pixels, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chr
+	}
+	blankWithMetadata := func(t *testing.T) *mcm.Char {
+		data := blankChar().Data()
+		data[mcm.MinCharBytes] = 1
+		chr, err := mcm.NewCharFromData(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chr
+	}
+	testCases := []struct {
+		rule    string
+		failing func(t *testing.T) charMap
+		passing func(t *testing.T) charMap
+		char    int
+		message string
+	}{
+		{
+			rule:    "missing-outline",
+			failing: func(t *testing.T) charMap { return charMap{65: testBoxChar(t, 3, 3, 4, 4, false)} },
+			passing: func(t *testing.T) charMap { return charMap{65: testBoxChar(t, 3, 3, 4, 4, true)} },
+			char:    65,
+			message: "transparent pixels touching white ones",
+		},
+		{
+			rule:    "gray-pixels",
+			failing: func(t *testing.T) charMap { return charMap{66: grayChar(t)} },
+			passing: func(t *testing.T) charMap { return charMap{66: testBoxChar(t, 3, 3, 4, 4, true)} },
+			char:    66,
+			message: "1 gray pixels",
+		},
+		{
+			rule:    "digits",
+			failing: func(t *testing.T) charMap { return testDigits(t, '1') },
+			passing: func(t *testing.T) charMap { return testDigits(t, -1) },
+			char:    '1',
+			message: "digit 1 has width 6, most digits have 8",
+		},
+		{
+			rule:    "edge-touching",
+			failing: func(t *testing.T) charMap { return charMap{67: testBoxChar(t, 0, 3, 4, 4, false)} },
+			passing: func(t *testing.T) charMap { return charMap{67: testBoxChar(t, 3, 3, 4, 4, true)} },
+			char:    67,
+			message: "white pixels touching the left edge",
+		},
+		{
+			rule: "duplicate",
+			failing: func(t *testing.T) charMap {
+				return charMap{68: testBoxChar(t, 3, 3, 4, 4, true), 69: testBoxChar(t, 3, 3, 4, 4, true)}
+			},
+			passing: func(t *testing.T) charMap {
+				return charMap{68: testBoxChar(t, 3, 3, 4, 4, true), 69: testBoxChar(t, 3, 3, 5, 4, true)}
+			},
+			char:    69,
+			message: "identical to character 068",
+		},
+		{
+			rule:    "blank-metadata",
+			failing: func(t *testing.T) charMap { return charMap{70: blankWithMetadata(t)} },
+			passing: func(t *testing.T) charMap { return charMap{70: testBoxChar(t, 3, 3, 4, 4, true)} },
+			char:    70,
+			message: "blank character has metadata",
+		},
+	}
+	for _, tc := range testCases {
+		// Run only the rule being tested
+		config := &lintConfig{Rules: make(map[string]*lintRuleConfig)}
+		for _, r := range lintRules {
+			if r.Name != tc.rule {
+				config.Rules[r.Name] = &lintRuleConfig{Severity: "off"}
+			}
+		}
+		issues, err := lintFont(testLintDecoder(t, tc.failing(t)), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(issues) != 1 || issues[0].Char != tc.char || !strings.Contains(issues[0].Message, tc.message) {
+			var messages []string
+			for _, v := range issues {
+				messages = append(messages, v.Message)
+			}
+			t.Errorf("%s: expecting an issue in character %03d with %q, got %v", tc.rule, tc.char, tc.message, messages)
+		}
+		issues, err = lintFont(testLintDecoder(t, tc.passing(t)), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(issues) != 0 {
+			t.Errorf("%s: expecting no issues, got %d, first %q", tc.rule, len(issues), issues[0].Message)
+		}
+	}
+}
+
+func TestLintConfig(t *testing.T) {
+	// Severities and selections from the config are honored
+	config := &lintConfig{Rules: map[string]*lintRuleConfig{
+		"missing-outline": {Severity: "error", Chars: "65"},
+	}}
+	issues, err := lintFont(testLintDecoder(t, charMap{
+		65: testBoxChar(t, 3, 3, 4, 4, false),
+		66: testBoxChar(t, 3, 3, 5, 4, false),
+	}), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outline []*lintIssue
+	for _, v := range issues {
+		if v.Rule == "missing-outline" {
+			outline = append(outline, v)
+		}
+	}
+	if len(outline) != 1 || outline[0].Char != 65 || outline[0].Severity != lintError {
+		t.Errorf("expecting a single missing-outline error in 065, got %+v", outline)
+	}
+	if _, err := lintFont(testLintDecoder(t, nil), &lintConfig{Target: "foo"}); err == nil {
+		t.Error("expecting an error with an invalid target")
+	}
+}
@@ -21,3 +21,34 @@ func logDebug(format string, v ...interface{}) error {
 	}
 	return nil
 }
+
+// prefixLogger logs messages with a prefix, so messages from fonts
+// generated in parallel can be told apart. A nil *prefixLogger
+// logs messages without a prefix.
+type prefixLogger struct {
+	prefix string
+}
+
+func newPrefixLogger(prefix string) *prefixLogger {
+	return &prefixLogger{prefix: prefix}
+}
+
+func (l *prefixLogger) message(format string, v ...interface{}) string {
+	msg := fmt.Sprintf(format, v...)
+	if l != nil && l.prefix != "" {
+		msg = "[" + l.prefix + "] " + msg
+	}
+	return msg
+}
+
+func (l *prefixLogger) Verbose(format string, v ...interface{}) {
+	if verboseFlag || debugFlag {
+		logger.Output(2, l.message(format, v...))
+	}
+}
+
+func (l *prefixLogger) Debug(format string, v ...interface{}) {
+	if debugFlag {
+		logger.Output(2, l.message(format, v...))
+	}
+}
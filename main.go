@@ -48,6 +48,24 @@ func main() {
 			Value:   defaultColumns,
 			Usage:   "Number of columns in the output image (used only for image input)",
 		},
+		&cli.StringSliceFlag{
+			Name:    "define",
+			Aliases: []string{"D"},
+			Usage:   "Value for define entries in the extra data and for ${key} in fonts.yaml, as key=value. Can be repeated",
+		},
+		&cli.StringFlag{
+			Name:  "merge",
+			Value: mergeAppend,
+			Usage: "How to merge extra data files touching the same character (append, replace or error), for files that don't declare it",
+		},
+		&cli.StringFlag{
+			Name:  "data-report",
+			Usage: "Write the file and line that produced each byte range in the extra data to the given file",
+		},
+		&cli.StringFlag{
+			Name:  "provenance",
+			Usage: "Write the origin (image and cell, parent font or extra data) and hash of every character to the given JSON file",
+		},
 	}
 	var buildFlags []cli.Flag
 	buildFlags = append(buildFlags, buildAndGenerateFlags...)
@@ -60,7 +78,36 @@ func main() {
 	generateFlags = append(generateFlags, buildAndGenerateFlags...)
 	generateFlags = append(generateFlags, &cli.BoolFlag{
 		Name:  "remove-duplicates",
-		Usage: "Remove duplicate characters that are the same in the child and parent font",
+		Usage: "Remove duplicate characters that are the same in the child and parent font, rewriting images with several characters and moving the original files to --backup-dir",
+	}, &cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "With --remove-duplicates, list the characters that would be removed without touching any file",
+	}, &cli.StringFlag{
+		Name:  "backup-dir",
+		Usage: "Directory for the files changed by --remove-duplicates, inside a subdirectory for each run (default: " + defaultBackupDir + " in the config directory)",
+	}, &cli.IntFlag{
+		Name:    "jobs",
+		Aliases: []string{"j"},
+		Value:   1,
+		Usage:   "Number of fonts to generate in parallel",
+	}, &cli.BoolFlag{
+		Name:  "rebuild",
+		Usage: "Build all fonts, even the ones whose inputs didn't change since the last build",
+	}, &cli.BoolFlag{
+		Name:  "no-cache",
+		Usage: "Don't read nor write the cache, building all fonts",
+	}, &cli.StringFlag{
+		Name:  "cache",
+		Usage: "Cache file used to skip fonts whose inputs didn't change (default: a file for each config in the user cache directory)",
+	}, &cli.BoolFlag{
+		Name:  "check",
+		Usage: "Build the fonts in memory without writing anything and fail if any output (or preview) is out of date",
+	}, &cli.StringSliceFlag{
+		Name:  "only",
+		Usage: "Build only the fonts matching the given globs (e.g. bold,large*), plus their parents. Can be repeated",
+	}, &cli.StringSliceFlag{
+		Name:  "exclude",
+		Usage: "Don't build the fonts matching the given globs, unless other fonts need them. Can be repeated",
 	})
 	app.Usage = "tool for managing .mcm character sets for MAX7456"
 	app.Flags = []cli.Flag{
@@ -97,6 +144,37 @@ func main() {
 			},
 			Action: extractAction,
 		},
+		{
+			Name:      "extract-payload",
+			Usage:     "Extract a payload spanning several consecutive characters",
+			ArgsUsage: "<input.mcm> <output.bin>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "start",
+					Aliases: []string{"s"},
+					Usage:   "First character of the payload",
+				},
+				&cli.BoolFlag{
+					Name:  "length",
+					Usage: "Payload starts with a length header",
+				},
+				&cli.StringFlag{
+					Name:  "crc",
+					Usage: "Payload has a CRC header (crc16 or crc32) which is verified, requires --length",
+				},
+				&cli.IntFlag{
+					Name:  "count",
+					Usage: "Number of characters to read, required for payloads without a length header",
+				},
+			},
+			Action: extractPayloadAction,
+		},
+		{
+			Name:      "dump-data",
+			Usage:     "Decode the extra data in a .mcm using an extra data file as the schema",
+			ArgsUsage: "<input.mcm> <schema.yaml> [output.yaml]",
+			Action:    dumpDataAction,
+		},
 		{
 			Name:      "build",
 			Usage:     "Build a .mcm from the files in the given directory or .png file",
@@ -144,6 +222,141 @@ func main() {
 			},
 			Action: binAction,
 		},
+		{
+			Name:      "transform",
+			Usage:     "Flip, rotate, shift or invert characters in a .mcm",
+			ArgsUsage: "<input.mcm> <output.mcm|output-dir>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "chars",
+					Aliases: []string{"r"},
+					Usage:   "Characters to transform, as a comma separated list of numbers or ranges (e.g. 1,16-31,0x41). Defaults to all",
+				},
+				&cli.StringSliceFlag{
+					Name:    "op",
+					Aliases: []string{"o"},
+					Usage:   transformOpsUsage,
+				},
+				&cli.BoolFlag{
+					Name:  "drop-metadata",
+					Usage: "Allow writing characters with metadata to a directory, discarding their metadata",
+				},
+			},
+			Action: transformAction,
+		},
+		{
+			Name:      "outline",
+			Usage:     "Add a black outline around white pixels in a .mcm",
+			ArgsUsage: "<input.mcm> <output.mcm>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "chars",
+					Aliases: []string{"r"},
+					Usage:   "Characters to outline, as a comma separated list of numbers or ranges (e.g. 1,16-31,0x41). Defaults to all",
+				},
+				&cli.IntFlag{
+					Name:    "neighbors",
+					Aliases: []string{"n"},
+					Value:   defaultOutlineNeighbors,
+					Usage:   "Pixels considered neighbors of a white pixel, either 4 (no diagonals) or 8",
+				},
+				&cli.BoolFlag{
+					Name:  "lint",
+					Usage: "Don't write any output, just report characters with white pixels touching transparent ones",
+				},
+			},
+			Action: outlineAction,
+		},
+		{
+			Name:        "lint",
+			Usage:       "Check a .mcm for common readability and consistency problems",
+			ArgsUsage:   "<input.mcm>",
+			Description: "Available rules and their default severities:\n\n" + lintRulesUsage(),
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "config",
+					Usage: "YAML file with the target and rule severities (off, info, warning or error)",
+				},
+				&cli.StringFlag{
+					Name:  "target",
+					Usage: "OSD the font is intended for, either max7456 (default) or frskyosd",
+				},
+				&cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "Output format, either text or json",
+				},
+				&cli.StringFlag{
+					Name:  "fail-on",
+					Value: "error",
+					Usage: "Minimum severity that makes the command fail, use off to never fail",
+				},
+			},
+			Action: lintAction,
+		},
+		{
+			Name:      "check",
+			Usage:     "Check that a .mcm contains all the characters required by a firmware",
+			ArgsUsage: "<input.mcm>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "firmware",
+					Aliases: []string{"symbols"},
+					Usage:   "Firmware symbol table, either as a path or a name (e.g. betaflight-4.4) looked up as <name>.yaml in --firmware-dir. All the characters in it are required. No tables are shipped with max7456tool, see example_symbols.yaml",
+				},
+				&cli.StringFlag{
+					Name:  "firmware-dir",
+					Usage: "Directory with the firmware symbol tables. Defaults to $" + firmwareDirEnv + " or ./" + defaultFirmwareDir,
+				},
+				&cli.StringFlag{
+					Name:  "required",
+					Usage: "File with the required characters, one number, range or symbol name per line",
+				},
+				&cli.BoolFlag{
+					Name:  "require-ascii",
+					Usage: "Consider all the printable ASCII characters as required",
+				},
+			},
+			Action: checkAction,
+		},
+		{
+			Name:      "migrate",
+			Usage:     "Move the characters of a custom font to a new firmware layout by matching the default fonts",
+			ArgsUsage: "<old-default.mcm> <new-default.mcm> <custom.mcm> <output.mcm>",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:    "tolerance",
+					Aliases: []string{"t"},
+					Value:   defaultMigrateTolerance,
+					Usage:   "Maximum number of different pixels to consider two characters a match",
+				},
+			},
+			Action: migrateAction,
+		},
+		{
+			Name:      "remap",
+			Usage:     "Move the characters of a font to a new layout using a mapping file",
+			ArgsUsage: "<input.mcm> <output.mcm>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "map",
+					Usage: "YAML (source: target) or CSV (source,target) mapping file. Sources and targets can be numbers, ranges or symbol names",
+				},
+				&cli.StringFlag{
+					Name:  "base",
+					Usage: "Font used to fill the characters not present in the mapping",
+				},
+				&cli.StringFlag{
+					Name:  "from",
+					Usage: "Firmware symbol table file used to resolve source symbol names",
+				},
+				&cli.StringFlag{
+					Name:  "to",
+					Usage: "Firmware symbol table file used to resolve target symbol names",
+				},
+			},
+			Action: remapAction,
+		},
 	}
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -51,6 +51,10 @@ const (
 	PixelGray = 3
 )
 
+// Pixels represents the visible pixels of a character,
+// indexed as [y][x].
+type Pixels [CharHeight][CharWidth]Pixel
+
 func (p Pixel) isTransparent() bool {
 	// Transparent pixels have the LSB
 	// set to 1 while MSB is ignored.
@@ -84,6 +88,31 @@ func NewCharFromImage(im image.Image, x0 int, y0 int) (*Char, error) {
 	return builder.Char(), nil
 }
 
+// NewCharFromPixels returns a Char with the given visible pixels
+// followed by the given metadata. Metadata might be at most
+// CharBytes - MinCharBytes bytes long and it's padded with
+// transparent bytes.
+func NewCharFromPixels(pixels *Pixels, metadata []byte) (*Char, error) {
+	if len(metadata) > CharBytes-MinCharBytes {
+		return nil, fmt.Errorf("metadata with %d bytes exceeds the maximum %d", len(metadata), CharBytes-MinCharBytes)
+	}
+	var builder charBuilder
+	builder.Reset()
+	for y := 0; y < CharHeight; y++ {
+		for x := 0; x < CharWidth; x++ {
+			if err := builder.AppendPixel(pixels[y][x]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c := builder.Char()
+	c.data = append(c.data, metadata...)
+	for len(c.data) < CharBytes {
+		c.data = append(c.data, mcmTransparentByte)
+	}
+	return c, nil
+}
+
 // Data returns a copy of the raw pixel data.
 func (c *Char) Data() []byte {
 	data := make([]byte, len(c.data))
@@ -91,6 +120,36 @@ func (c *Char) Data() []byte {
 	return data
 }
 
+// Metadata returns a copy of the data stored after the
+// visible pixels.
+func (c *Char) Metadata() []byte {
+	if len(c.data) <= MinCharBytes {
+		return nil
+	}
+	data := make([]byte, len(c.data)-MinCharBytes)
+	copy(data, c.data[MinCharBytes:])
+	return data
+}
+
+// PixelAt returns the pixel at (x, y). x must be in [0, CharWidth)
+// and y in [0, CharHeight).
+func (c *Char) PixelAt(x, y int) Pixel {
+	idx := y*CharWidth + x
+	shift := uint(6 - 2*(idx%4))
+	return Pixel((c.data[idx/4] >> shift) & 0x03)
+}
+
+// Pixels returns a copy of the visible pixels in the character.
+func (c *Char) Pixels() *Pixels {
+	var p Pixels
+	for y := 0; y < CharHeight; y++ {
+		for x := 0; x < CharWidth; x++ {
+			p[y][x] = c.PixelAt(x, y)
+		}
+	}
+	return &p
+}
+
 // ForEachPixel calls f for each pixel in the character.
 // 0 <= x <= 12 while y >= 0. Note that a character might
 // have extra ignored pixels at the end. unused will be true
@@ -196,6 +255,20 @@ func (c *Char) VisibleEqual(other *Char) bool {
 	return bytes.Equal(c.data[:MinCharBytes], other.data[:MinCharBytes])
 }
 
+// VisibleDistance returns the number of visible pixels that
+// differ between both characters.
+func (c *Char) VisibleDistance(other *Char) int {
+	dist := 0
+	for y := 0; y < CharHeight; y++ {
+		for x := 0; x < CharWidth; x++ {
+			if c.PixelAt(x, y) != other.PixelAt(x, y) {
+				dist++
+			}
+		}
+	}
+	return dist
+}
+
 // MetadataIsBlank returns true iff the metadata section of the
 // character contains only transparent bytes.
 func (c *Char) MetadataIsBlank() bool {
@@ -0,0 +1,74 @@
+package mcm
+
+import (
+	"fmt"
+	"image"
+)
+
+// Connectivity indicates which pixels are considered neighbors
+// of a given pixel.
+type Connectivity int
+
+const (
+	// Connectivity4 considers only the pixels directly above, below,
+	// left and right of a pixel as its neighbors.
+	Connectivity4 Connectivity = 4
+	// Connectivity8 considers also the diagonal pixels as neighbors.
+	Connectivity8 Connectivity = 8
+)
+
+var (
+	neighbors4 = []image.Point{{0, -1}, {-1, 0}, {1, 0}, {0, 1}}
+	neighbors8 = []image.Point{{-1, -1}, {0, -1}, {1, -1}, {-1, 0}, {1, 0}, {-1, 1}, {0, 1}, {1, 1}}
+)
+
+func (c Connectivity) neighbors() []image.Point {
+	switch c {
+	case Connectivity4:
+		return neighbors4
+	case Connectivity8:
+		return neighbors8
+	}
+	panic(fmt.Errorf("invalid connectivity %d", int(c)))
+}
+
+// MissingOutline returns the transparent pixels that are neighbors of
+// a white pixel, according to the given connectivity. These are
+// the pixels that Outline would turn black.
+func MissingOutline(c *Char, conn Connectivity) []image.Point {
+	neighbors := conn.neighbors()
+	pixels := c.Pixels()
+	var points []image.Point
+	for y := 0; y < CharHeight; y++ {
+		for x := 0; x < CharWidth; x++ {
+			if pixels[y][x] != PixelTransparent {
+				continue
+			}
+			for _, n := range neighbors {
+				nx := x + n.X
+				ny := y + n.Y
+				if nx < 0 || nx >= CharWidth || ny < 0 || ny >= CharHeight {
+					continue
+				}
+				if pixels[ny][nx] == PixelWhite {
+					points = append(points, image.Pt(x, y))
+					break
+				}
+			}
+		}
+	}
+	return points
+}
+
+// Outline returns a copy of c where all the transparent pixels
+// which are neighbors of a white pixel have been turned black.
+// Black and gray pixels as well as the metadata are left untouched.
+func Outline(c *Char, conn Connectivity) *Char {
+	missing := MissingOutline(c, conn)
+	return transformPixels(c, func(src *Pixels, dst *Pixels) {
+		*dst = *src
+		for _, p := range missing {
+			dst[p.Y][p.X] = PixelBlack
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package mcm
+
+import (
+	"testing"
+)
+
+func TestOutline(t *testing.T) {
+	var pixels Pixels
+	for y := range pixels {
+		for x := range pixels[y] {
+			pixels[y][x] = PixelTransparent
+		}
+	}
+	pixels[5][5] = PixelWhite
+	pixels[4][5] = PixelBlack
+	pixels[0][0] = PixelWhite
+	chr, err := NewCharFromPixels(&pixels, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(MissingOutline(chr, Connectivity4)); n != 3+2 {
+		t.Errorf("expecting 5 missing outline pixels with 4-connectivity, got %d", n)
+	}
+	if n := len(MissingOutline(chr, Connectivity8)); n != 7+3 {
+		t.Errorf("expecting 10 missing outline pixels with 8-connectivity, got %d", n)
+	}
+	outlined := Outline(chr, Connectivity8)
+	if n := len(MissingOutline(outlined, Connectivity8)); n != 0 {
+		t.Errorf("outlined character still misses %d pixels", n)
+	}
+	for _, p := range []struct{ x, y int }{{4, 4}, {5, 4}, {6, 6}, {1, 1}} {
+		if px := outlined.PixelAt(p.x, p.y); px != PixelBlack {
+			t.Errorf("pixel %d,%d = %v, expecting black", p.x, p.y, px)
+		}
+	}
+	if px := outlined.PixelAt(5, 5); px != PixelWhite {
+		t.Errorf("white pixel was modified to %v", px)
+	}
+	if !outlined.VisibleEqual(Outline(chr, Connectivity8)) || outlined.Equal(chr) {
+		t.Error("outline is not deterministic or didn't change the character")
+	}
+	if string(outlined.Metadata()[:3]) != string([]byte{1, 2, 3}) {
+		t.Error("outline didn't preserve the metadata")
+	}
+}
@@ -0,0 +1,105 @@
+package mcm
+
+// Transform is a function which returns a modified copy
+// of a character. Transforms never modify their input.
+type Transform func(c *Char) *Char
+
+func transformPixels(c *Char, f func(src *Pixels, dst *Pixels)) *Char {
+	var dst Pixels
+	f(c.Pixels(), &dst)
+	chr, err := NewCharFromPixels(&dst, c.Metadata())
+	if err != nil {
+		// Should not happen, metadata comes from a valid character
+		panic(err)
+	}
+	return chr
+}
+
+// FlipHorizontal returns a copy of c mirrored around its vertical axis.
+// Metadata is preserved.
+func FlipHorizontal(c *Char) *Char {
+	return transformPixels(c, func(src *Pixels, dst *Pixels) {
+		for y := 0; y < CharHeight; y++ {
+			for x := 0; x < CharWidth; x++ {
+				dst[y][x] = src[y][CharWidth-1-x]
+			}
+		}
+	})
+}
+
+// FlipVertical returns a copy of c mirrored around its horizontal axis.
+// Metadata is preserved.
+func FlipVertical(c *Char) *Char {
+	return transformPixels(c, func(src *Pixels, dst *Pixels) {
+		for y := 0; y < CharHeight; y++ {
+			dst[y] = src[CharHeight-1-y]
+		}
+	})
+}
+
+// Rotate180 returns a copy of c rotated by 180 degrees.
+// Metadata is preserved.
+func Rotate180(c *Char) *Char {
+	return transformPixels(c, func(src *Pixels, dst *Pixels) {
+		for y := 0; y < CharHeight; y++ {
+			for x := 0; x < CharWidth; x++ {
+				dst[y][x] = src[CharHeight-1-y][CharWidth-1-x]
+			}
+		}
+	})
+}
+
+// Invert returns a copy of c with black and white pixels
+// swapped. Transparent and gray pixels are left untouched.
+// Metadata is preserved.
+func Invert(c *Char) *Char {
+	return transformPixels(c, func(src *Pixels, dst *Pixels) {
+		for y := 0; y < CharHeight; y++ {
+			for x := 0; x < CharWidth; x++ {
+				p := src[y][x]
+				switch p {
+				case PixelBlack:
+					p = PixelWhite
+				case PixelWhite:
+					p = PixelBlack
+				}
+				dst[y][x] = p
+			}
+		}
+	})
+}
+
+// Shift returns a copy of c with its pixels moved dx pixels to
+// the right and dy pixels down (negative values move left and up).
+// If wrap is true, pixels moved out of the character appear on the
+// opposite side. Otherwise, uncovered pixels are set to fill.
+// Metadata is preserved.
+func Shift(c *Char, dx, dy int, wrap bool, fill Pixel) *Char {
+	return transformPixels(c, func(src *Pixels, dst *Pixels) {
+		for y := 0; y < CharHeight; y++ {
+			for x := 0; x < CharWidth; x++ {
+				sx := x - dx
+				sy := y - dy
+				if wrap {
+					sx = ((sx % CharWidth) + CharWidth) % CharWidth
+					sy = ((sy % CharHeight) + CharHeight) % CharHeight
+				} else if sx < 0 || sx >= CharWidth || sy < 0 || sy >= CharHeight {
+					dst[y][x] = fill
+					continue
+				}
+				dst[y][x] = src[sy][sx]
+			}
+		}
+	})
+}
+
+// ClearMetadata returns a copy of c with the same visible pixels
+// and all metadata bytes set to transparent.
+func ClearMetadata(c *Char) *Char {
+	chr, err := NewCharFromPixels(c.Pixels(), nil)
+	if err != nil {
+		// Should not happen
+		panic(err)
+	}
+	return chr
+}
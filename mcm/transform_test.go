@@ -0,0 +1,72 @@
+package mcm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testDecodeVision(t *testing.T) *Decoder {
+	f, err := os.Open(filepath.Join("_testdata", "vision.mcm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dec, err := NewDecoder(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dec
+}
+
+func TestPixelsRoundTrip(t *testing.T) {
+	dec := testDecodeVision(t)
+	for ii := 0; ii < dec.NChars(); ii++ {
+		chr := dec.CharAt(ii)
+		cpy, err := NewCharFromPixels(chr.Pixels(), chr.Metadata())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !chr.Equal(cpy) {
+			t.Fatalf("character %d changed after a round trip through Pixels()", ii)
+		}
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	dec := testDecodeVision(t)
+	chr := dec.CharAt(150)
+	if chr.MetadataIsBlank() {
+		t.Fatal("test character should have metadata")
+	}
+	for _, f := range []Transform{FlipHorizontal, FlipVertical, Rotate180, Invert} {
+		twice := f(f(chr))
+		if !twice.Equal(chr) {
+			t.Errorf("applying transform twice doesn't produce the original character")
+		}
+		if !bytes.Equal(f(chr).Metadata(), chr.Metadata()) {
+			t.Errorf("transform didn't preserve metadata")
+		}
+	}
+	if !Rotate180(chr).Equal(FlipVertical(FlipHorizontal(chr))) {
+		t.Error("Rotate180 != FlipVertical(FlipHorizontal)")
+	}
+	if !Shift(Shift(chr, 3, -5, true, PixelTransparent), -3, 5, true, PixelTransparent).Equal(chr) {
+		t.Error("shifting with wrap back and forth doesn't produce the original character")
+	}
+	shifted := Shift(chr, 0, 1, false, PixelBlack)
+	for x := 0; x < CharWidth; x++ {
+		if p := shifted.PixelAt(x, 0); p != PixelBlack {
+			t.Errorf("pixel %d,0 = %v after shift, expecting fill", x, p)
+		}
+		for y := 1; y < CharHeight; y++ {
+			if shifted.PixelAt(x, y) != chr.PixelAt(x, y-1) {
+				t.Errorf("pixel %d,%d was not shifted", x, y)
+			}
+		}
+	}
+	if !ClearMetadata(chr).MetadataIsBlank() {
+		t.Error("ClearMetadata() didn't clear the metadata")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fiam/max7456tool/mcm"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	defaultMigrateTolerance = 4
+)
+
+// slotMatch indicates where a character in the new layout comes
+// from in the old one.
+type slotMatch struct {
+	From     int
+	Distance int
+}
+
+// matchLayouts returns, for each non blank character in newChars,
+// the character in oldChars with the same glyph or, if there's no
+// exact match, the one with the fewest different pixels up to
+// tolerance. Candidates at the same index are preferred. Characters
+// without a match are not present in the returned map.
+func matchLayouts(oldChars, newChars []*mcm.Char, tolerance int) map[int]*slotMatch {
+	matches := make(map[int]*slotMatch)
+	for ii, nc := range newChars {
+		if nc.IsBlank() {
+			continue
+		}
+		var best *slotMatch
+		for jj, oc := range oldChars {
+			if oc.IsBlank() {
+				continue
+			}
+			dist := nc.VisibleDistance(oc)
+			if dist > tolerance {
+				continue
+			}
+			if best == nil || dist < best.Distance || (dist == best.Distance && jj == ii) {
+				best = &slotMatch{From: jj, Distance: dist}
+			}
+		}
+		if best != nil {
+			matches[ii] = best
+		}
+	}
+	return matches
+}
+
+// migrateResult is the result of moving a custom font to a new layout
+type migrateResult struct {
+	Chars   charMap
+	Matches map[int]*slotMatch
+	// Unmatched contains the characters in the new layout without
+	// a match in the old one, copied from the new default font
+	Unmatched []int
+	// Dropped contains the customized characters in the old layout
+	// without a slot in the new one
+	Dropped []int
+	// Unplaced contains the custom characters in slots that are blank
+	// in the old default font, which couldn't be kept in the same slot
+	// because it's used in the new layout
+	Unplaced []int
+}
+
+// migrateChars moves customChars, based on the oldChars layout, to the
+// newChars one. Custom characters in slots which are blank in oldChars
+// are kept in the same slot when it's also blank in newChars.
+func migrateChars(oldChars, newChars, customChars []*mcm.Char, tolerance int) *migrateResult {
+	res := &migrateResult{
+		Chars:   make(charMap),
+		Matches: matchLayouts(oldChars, newChars, tolerance),
+	}
+	used := make(map[int]bool)
+	for ii, nc := range newChars {
+		if nc.IsBlank() {
+			continue
+		}
+		m := res.Matches[ii]
+		if m == nil {
+			// Keep the glyph from the new default font, so the
+			// result is still usable
+			res.Unmatched = append(res.Unmatched, ii)
+			res.Chars[ii] = nc
+			continue
+		}
+		used[m.From] = true
+		res.Chars[ii] = customChars[m.From]
+		if m.From != ii {
+			logVerbose("moving character %03d to %03d (%d different pixels)", m.From, ii, m.Distance)
+		} else if m.Distance > 0 {
+			logDebug("keeping character %03d, %d different pixels", ii, m.Distance)
+		}
+	}
+	for ii, oc := range oldChars {
+		cc := customChars[ii]
+		if oc.IsBlank() {
+			if cc.IsBlank() {
+				continue
+			}
+			// Custom glyph with no counterpart in the old layout
+			if ii < len(newChars) && res.Chars[ii] == nil {
+				logVerbose("keeping custom character %03d in the same slot", ii)
+				res.Chars[ii] = cc
+			} else {
+				res.Unplaced = append(res.Unplaced, ii)
+			}
+			continue
+		}
+		if used[ii] || cc.Equal(oc) {
+			// Either moved or not customized, nothing is lost
+			continue
+		}
+		res.Dropped = append(res.Dropped, ii)
+	}
+	return res
+}
+
+func decoderChars(dec *mcm.Decoder) []*mcm.Char {
+	chars := make([]*mcm.Char, dec.NChars())
+	for ii := range chars {
+		chars[ii] = dec.CharAt(ii)
+	}
+	return chars
+}
+
+func migrateAction(ctx *cli.Context) error {
+	if ctx.NArg() != 4 {
+		return errors.New("migrate requires 4 arguments, see help migrate")
+	}
+	tolerance := ctx.Int("tolerance")
+	if tolerance < 0 {
+		return fmt.Errorf("invalid tolerance %d, must be >= 0", tolerance)
+	}
+	var decs []*mcm.Decoder
+	for ii := 0; ii < 3; ii++ {
+		dec, err := decodeMCMFile(ctx.Args().Get(ii))
+		if err != nil {
+			return err
+		}
+		decs = append(decs, dec)
+	}
+	oldChars := decoderChars(decs[0])
+	newChars := decoderChars(decs[1])
+	customChars := decoderChars(decs[2])
+	if len(customChars) != len(oldChars) {
+		return fmt.Errorf("custom font has %d characters but the old default font has %d", len(customChars), len(oldChars))
+	}
+	output := ctx.Args().Get(3)
+
+	res := migrateChars(oldChars, newChars, customChars, tolerance)
+	if err := buildMCM(output, &mcm.Encoder{Chars: res.Chars, Fill: true}); err != nil {
+		return err
+	}
+
+	for _, n := range res.Unmatched {
+		fmt.Printf("character %03d in the new layout has no match in the old one, copied from the new default font\n", n)
+	}
+	for _, n := range res.Dropped {
+		fmt.Printf("customized character %03d has no slot in the new layout and was dropped\n", n)
+	}
+	for _, n := range res.Unplaced {
+		fmt.Printf("custom character %03d is blank in the old default font and its slot is used in the new layout, it was not placed\n", n)
+	}
+	for ii := range newChars {
+		if m := res.Matches[ii]; m != nil && m.Distance > 0 {
+			fmt.Printf("character %03d was matched to %03d with %d different pixels, verify it manually\n", ii, m.From, m.Distance)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fiam/max7456tool/mcm"
+)
+
+// testLayout returns n characters, with a box of width w at each
+// index in boxes and blank characters everywhere else
+func testLayout(t *testing.T, n int, boxes map[int]int) []*mcm.Char {
+	chars := make([]*mcm.Char, n)
+	for ii := range chars {
+		if w, ok := boxes[ii]; ok {
+			chars[ii] = testBoxChar(t, 1, 1, w, 4, true)
+		} else {
+			chars[ii] = blankChar()
+		}
+	}
+	return chars
+}
+
+func TestMatchLayouts(t *testing.T) {
+	testCases := []struct {
+		name      string
+		old       map[int]int
+		new       map[int]int
+		tolerance int
+		expected  map[int]slotMatch
+	}{
+		{
+			name:     "unchanged",
+			old:      map[int]int{1: 2, 2: 3},
+			new:      map[int]int{1: 2, 2: 3},
+			expected: map[int]slotMatch{1: {From: 1}, 2: {From: 2}},
+		},
+		{
+			name:     "moved",
+			old:      map[int]int{1: 2, 2: 3},
+			new:      map[int]int{3: 2, 1: 3},
+			expected: map[int]slotMatch{3: {From: 1}, 1: {From: 2}},
+		},
+		{
+			name:     "new glyph",
+			old:      map[int]int{1: 2},
+			new:      map[int]int{1: 2, 2: 6},
+			expected: map[int]slotMatch{1: {From: 1}},
+		},
+		{
+			// One more column changes 4 pixels to white
+			// and moves the 6 outline pixels on the right
+			name:      "within tolerance",
+			old:       map[int]int{1: 2},
+			new:       map[int]int{2: 3},
+			tolerance: 10,
+			expected:  map[int]slotMatch{2: {From: 1, Distance: 10}},
+		},
+		{
+			name:      "over tolerance",
+			old:       map[int]int{1: 2},
+			new:       map[int]int{2: 3},
+			tolerance: 9,
+			expected:  map[int]slotMatch{},
+		},
+		{
+			name:     "collision prefers the same index",
+			old:      map[int]int{1: 2, 2: 2},
+			new:      map[int]int{2: 2},
+			expected: map[int]slotMatch{2: {From: 2}},
+		},
+	}
+	for _, tc := range testCases {
+		matches := matchLayouts(testLayout(t, 4, tc.old), testLayout(t, 4, tc.new), tc.tolerance)
+		got := make(map[int]slotMatch, len(matches))
+		for k, v := range matches {
+			got[k] = *v
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expecting %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestMigrateChars(t *testing.T) {
+	custom := func(w int) *mcm.Char { return testBoxChar(t, 6, 6, w, 4, false) }
+	testCases := []struct {
+		name      string
+		old       map[int]int
+		new       map[int]int
+		custom    map[int]*mcm.Char
+		chars     map[int]*mcm.Char
+		dropped   []int
+		unplaced  []int
+		unmatched []int
+	}{
+		{
+			name:   "moved customized",
+			old:    map[int]int{1: 2},
+			new:    map[int]int{2: 2},
+			custom: map[int]*mcm.Char{1: custom(3)},
+			chars:  map[int]*mcm.Char{2: custom(3)},
+		},
+		{
+			name:    "customized without a slot",
+			old:     map[int]int{1: 2},
+			new:     map[int]int{},
+			custom:  map[int]*mcm.Char{1: custom(3)},
+			chars:   map[int]*mcm.Char{},
+			dropped: []int{1},
+		},
+		{
+			name:   "custom in a free slot",
+			old:    map[int]int{1: 2},
+			new:    map[int]int{1: 2},
+			custom: map[int]*mcm.Char{3: custom(3)},
+			chars:  map[int]*mcm.Char{1: testBoxChar(t, 1, 1, 2, 4, true), 3: custom(3)},
+		},
+		{
+			name:      "custom colliding with the new layout",
+			old:       map[int]int{1: 2},
+			new:       map[int]int{1: 2, 3: 5},
+			custom:    map[int]*mcm.Char{3: custom(3)},
+			chars:     map[int]*mcm.Char{1: testBoxChar(t, 1, 1, 2, 4, true), 3: testBoxChar(t, 1, 1, 5, 4, true)},
+			unplaced:  []int{3},
+			unmatched: []int{3},
+		},
+	}
+	for _, tc := range testCases {
+		oldChars := testLayout(t, 4, tc.old)
+		customChars := make([]*mcm.Char, len(oldChars))
+		copy(customChars, oldChars)
+		for k, v := range tc.custom {
+			customChars[k] = v
+		}
+		res := migrateChars(oldChars, testLayout(t, 4, tc.new), customChars, 0)
+		if len(res.Chars) != len(tc.chars) {
+			t.Errorf("%s: expecting %d characters, got %d", tc.name, len(tc.chars), len(res.Chars))
+		}
+		for k, v := range tc.chars {
+			if chr := res.Chars[k]; chr == nil || !chr.Equal(v) {
+				t.Errorf("%s: unexpected character %03d", tc.name, k)
+			}
+		}
+		if !reflect.DeepEqual(res.Dropped, tc.dropped) {
+			t.Errorf("%s: expecting dropped %v, got %v", tc.name, tc.dropped, res.Dropped)
+		}
+		if !reflect.DeepEqual(res.Unplaced, tc.unplaced) {
+			t.Errorf("%s: expecting unplaced %v, got %v", tc.name, tc.unplaced, res.Unplaced)
+		}
+		if !reflect.DeepEqual(res.Unmatched, tc.unmatched) {
+			t.Errorf("%s: expecting unmatched %v, got %v", tc.name, tc.unmatched, res.Unmatched)
+		}
+	}
+}
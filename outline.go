@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/fiam/max7456tool/mcm"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultOutlineNeighbors = 8
+)
+
+// outlineOptions indicates which characters should get a black
+// outline added around their white pixels. It can be
+// specified per font in fonts.yaml as:
+//
+//	outline: true # all characters, 8-connected
+//	outline:
+//	  chars: 0x20-0x7f
+//	  neighbors: 4
+type outlineOptions struct {
+	Chars     string `yaml:"chars"`
+	Neighbors int    `yaml:"neighbors"`
+}
+
+func (o *outlineOptions) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var enabled bool
+		if err := node.Decode(&enabled); err != nil {
+			return err
+		}
+		if !enabled {
+			return errors.New("outline: false is not supported, remove the key instead")
+		}
+		*o = outlineOptions{}
+		return nil
+	}
+	type plain outlineOptions
+	return node.Decode((*plain)(o))
+}
+
+func (o *outlineOptions) Connectivity() (mcm.Connectivity, error) {
+	switch o.Neighbors {
+	case 0:
+		return defaultOutlineNeighbors, nil
+	case 4, 8:
+		return mcm.Connectivity(o.Neighbors), nil
+	}
+	return 0, fmt.Errorf("invalid outline neighbors %d, must be 4 or 8", o.Neighbors)
+}
+
+// Apply adds the outline to the selected characters in chars.
+func (o *outlineOptions) Apply(chars charMap, charNum int, log *prefixLogger) error {
+	conn, err := o.Connectivity()
+	if err != nil {
+		return err
+	}
+	selection, err := parseCharSelection(o.Chars, charNum)
+	if err != nil {
+		return err
+	}
+	for _, n := range selection {
+		if chr := chars[n]; chr != nil {
+			if missing := mcm.MissingOutline(chr, conn); len(missing) > 0 {
+				log.Debug("adding %d outline pixels to character %03d", len(missing), n)
+				chars[n] = mcm.Outline(chr, conn)
+			}
+		}
+	}
+	return nil
+}
+
+func outlineAction(ctx *cli.Context) error {
+	lint := ctx.Bool("lint")
+	if (lint && ctx.NArg() != 1) || (!lint && ctx.NArg() != 2) {
+		return errors.New("outline requires 2 arguments (1 with --lint), see help outline")
+	}
+	opts := &outlineOptions{
+		Chars:     ctx.String("chars"),
+		Neighbors: ctx.Int("neighbors"),
+	}
+	conn, err := opts.Connectivity()
+	if err != nil {
+		return err
+	}
+	input := ctx.Args().Get(0)
+	dec, err := decodeMCMFile(input)
+	if err != nil {
+		return err
+	}
+	chars := decoderCharMap(dec)
+	if lint {
+		selection, err := parseCharSelection(opts.Chars, dec.NChars())
+		if err != nil {
+			return err
+		}
+		count := 0
+		for _, n := range selection {
+			if missing := mcm.MissingOutline(chars[n], conn); len(missing) > 0 {
+				var points []string
+				for _, p := range missing {
+					points = append(points, fmt.Sprintf("(%d,%d)", p.X, p.Y))
+				}
+				fmt.Printf("character %03d: transparent pixels touching white at %s\n", n, strings.Join(points, " "))
+				count++
+			}
+		}
+		if count > 0 {
+			return fmt.Errorf("%d characters in %s are missing their outline", count, input)
+		}
+		return nil
+	}
+	if err := opts.Apply(chars, dec.NChars(), nil); err != nil {
+		return err
+	}
+	output := ctx.Args().Get(1)
+	if strings.ToLower(filepath.Ext(output)) != ".mcm" {
+		return fmt.Errorf("output %s must be a .mcm file", output)
+	}
+	return buildMCM(output, &mcm.Encoder{Chars: chars})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fiam/max7456tool/mcm"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	outputMCM     = "mcm"
+	outputPNG     = "png"
+	outputBin     = "bin"
+	outputHD      = "hd"
+	outputCHeader = "c-header"
+	outputText    = "text"
+
+	defaultHDScale   = 2
+	hdColumns        = 16
+	cHeaderBytesLine = 16
+)
+
+var (
+	outputPathVariableRe = regexp.MustCompile(`\{[^{}]*\}`)
+	cIdentifierRe        = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	cNonIdentifierRe     = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// generateOutputConfig is an entry in the outputs list of a font or
+// of the whole config. It might be just a format name, using the
+// default path for it.
+type generateOutputConfig struct {
+	Format string `yaml:"format"`
+	// Path is relative to the config file and might contain
+	// the {source} and {name} variables, see outputPath
+	Path string `yaml:"path"`
+	// Flip flips the order of the horizontal pixels (bin and c-header)
+	Flip bool `yaml:"flip"`
+	// Scale is the scale factor for hd, 2 by default
+	Scale int `yaml:"scale"`
+	// Name is the name of the array for c-header
+	Name string `yaml:"name"`
+}
+
+func (o *generateOutputConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*o = generateOutputConfig{Format: node.Value}
+		return nil
+	}
+	type plain generateOutputConfig
+	return node.Decode((*plain)(o))
+}
+
+func (o *generateOutputConfig) validate() error {
+	switch o.Format {
+	case outputMCM, outputPNG, outputBin, outputHD, outputCHeader, outputText:
+	case "":
+		return fmt.Errorf("output requires a format")
+	default:
+		return fmt.Errorf("unknown output format %q, valid formats are %s", o.Format,
+			strings.Join([]string{outputMCM, outputPNG, outputBin, outputHD, outputCHeader, outputText}, ", "))
+	}
+	if o.Flip && o.Format != outputBin && o.Format != outputCHeader {
+		return fmt.Errorf("flip can only be used with %s and %s outputs", outputBin, outputCHeader)
+	}
+	if o.Scale != 0 && o.Format != outputHD {
+		return fmt.Errorf("scale can only be used with %s outputs", outputHD)
+	}
+	if o.Scale < 0 {
+		return fmt.Errorf("invalid scale %d", o.Scale)
+	}
+	if o.Name != "" {
+		if o.Format != outputCHeader {
+			return fmt.Errorf("name can only be used with %s outputs", outputCHeader)
+		}
+		if !cIdentifierRe.MatchString(o.Name) {
+			return fmt.Errorf("name %q is not a valid C identifier", o.Name)
+		}
+	}
+	for _, v := range outputPathVariableRe.FindAllString(o.Path, -1) {
+		if v != "{source}" && v != "{name}" {
+			return fmt.Errorf("unknown variable %s in path %q, valid ones are {source} and {name}", v, o.Path)
+		}
+	}
+	return nil
+}
+
+// outputPath returns the path for the output of font, relative to the
+// config. In templates, {source} is replaced by the source of the font
+// without its extension and {name} by its last element.
+func (o *generateOutputConfig) outputPath(font *generateFontConfig) string {
+	source := strings.TrimSuffix(font.Source, filepath.Ext(font.Source))
+	tmpl := o.Path
+	if tmpl == "" {
+		switch o.Format {
+		case outputMCM:
+			if font.Output != "" {
+				return font.Output
+			}
+			tmpl = "{source}.mcm"
+		case outputPNG:
+			tmpl = "{source}.png"
+		case outputBin:
+			tmpl = "{source}.bin"
+		case outputHD:
+			tmpl = "{source}_hd.png"
+		case outputCHeader:
+			tmpl = "{source}.h"
+		case outputText:
+			tmpl = "{source}.txt"
+		}
+	}
+	r := strings.NewReplacer("{source}", source, "{name}", filepath.Base(source))
+	return r.Replace(tmpl)
+}
+
+// fontOutput is an output for a given font, with its path resolved
+type fontOutput struct {
+	Config *generateOutputConfig
+	Font   *generateFontConfig
+	Path   string
+}
+
+func (o *fontOutput) Format() string {
+	return o.Config.Format
+}
+
+// Render returns the contents of the output, given the data of the
+// font encoded as .mcm and a decoder for it
+func (o *fontOutput) Render(mcmData []byte, dec *mcm.Decoder, opts *buildOptions) ([]byte, error) {
+	switch o.Config.Format {
+	case outputMCM:
+		return mcmData, nil
+	case outputPNG:
+		return encodePNG(mcmImage(dec, opts.Columns, opts.Margin))
+	case outputBin:
+		return binData(dec, o.Config.Flip), nil
+	case outputHD:
+		scale := o.Config.Scale
+		if scale == 0 {
+			scale = defaultHDScale
+		}
+		return encodePNG(hdImage(dec, scale))
+	case outputCHeader:
+		return o.cHeader(dec), nil
+	case outputText:
+		return textData(dec), nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", o.Config.Format)
+}
+
+// CharSize returns the number of bytes used by each character in the
+// output, if they're stored one after another. Otherwise, it returns 0.
+func (o *fontOutput) CharSize() int {
+	if o.Config.Format == outputBin {
+		return mcm.CharBytes
+	}
+	return 0
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// hdImage draws the characters in dec scaled by the given factor, in
+// a grid of hdColumns columns without margins. Transparent pixels
+// are kept transparent.
+func hdImage(dec *mcm.Decoder, scale int) *image.RGBA {
+	rows := (dec.NChars() + hdColumns - 1) / hdColumns
+	w := mcm.CharWidth * scale
+	h := mcm.CharHeight * scale
+	img := image.NewRGBA(image.Rect(0, 0, w*hdColumns, h*rows))
+	transparent := &color.RGBA{}
+	for ii := 0; ii < dec.NChars(); ii++ {
+		cim := dec.CharAt(ii).Image(transparent)
+		x0 := (ii % hdColumns) * w
+		y0 := (ii / hdColumns) * h
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.Set(x0+x, y0+y, cim.At(x/scale, y/scale))
+			}
+		}
+	}
+	return img
+}
+
+// cHeader returns a C header declaring an array with the
+// data for all the characters
+func (o *fontOutput) cHeader(dec *mcm.Decoder) []byte {
+	name := o.Config.Name
+	if name == "" {
+		source := strings.TrimSuffix(o.Font.Source, filepath.Ext(o.Font.Source))
+		name = "font_" + cNonIdentifierRe.ReplaceAllString(filepath.Base(source), "_")
+	}
+	upper := strings.ToUpper(name)
+	data := binData(dec, o.Config.Flip)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Generated by max7456tool from %s, do not edit\n\n", o.Font.Source)
+	fmt.Fprintf(&buf, "#pragma once\n\n#include <stdint.h>\n\n")
+	fmt.Fprintf(&buf, "#define %s_CHAR_COUNT %d\n", upper, dec.NChars())
+	fmt.Fprintf(&buf, "#define %s_CHAR_BYTES %d\n\n", upper, mcm.CharBytes)
+	fmt.Fprintf(&buf, "static const uint8_t %s[%s_CHAR_COUNT][%s_CHAR_BYTES] = {\n", name, upper, upper)
+	for ii := 0; ii < dec.NChars(); ii++ {
+		chr := data[ii*mcm.CharBytes : (ii+1)*mcm.CharBytes]
+		fmt.Fprintf(&buf, "    // %03d\n    {\n", ii)
+		for jj := 0; jj < len(chr); jj += cHeaderBytesLine {
+			buf.WriteString("       ")
+			for _, b := range chr[jj : jj+cHeaderBytesLine] {
+				fmt.Fprintf(&buf, " 0x%02x,", b)
+			}
+			buf.WriteByte('\n')
+		}
+		buf.WriteString("    },\n")
+	}
+	buf.WriteString("};\n")
+	return buf.Bytes()
+}
+
+// textData returns the characters in dec drawn with the same symbols
+// used by the pixels entry in the extra data, each one preceded by
+// its number and followed by its metadata, if it's not blank
+func textData(dec *mcm.Decoder) []byte {
+	var buf bytes.Buffer
+	for ii := 0; ii < dec.NChars(); ii++ {
+		chr := dec.CharAt(ii)
+		if ii > 0 {
+			buf.WriteByte('\n')
+		}
+		fmt.Fprintf(&buf, "%03d\n", ii)
+		for _, row := range formatPixelArt(chr) {
+			buf.WriteString(row)
+			buf.WriteByte('\n')
+		}
+		if !chr.MetadataIsBlank() {
+			fmt.Fprintf(&buf, "metadata: % x\n", chr.Metadata())
+		}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/fiam/max7456tool/mcm"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	payloadLengthSize = 2
+)
+
+// payloadOptions indicates which headers are prepended to
+// a payload. If Length is true, the payload starts with its
+// length (excluding the headers) as a little endian uint16.
+// If CRC is non empty, the CRC of the payload (excluding the
+// headers) follows, in little endian. CRC requires Length.
+type payloadOptions struct {
+	Length bool
+	CRC    string
+}
+
+// validate returns an error if the options can't be used to
+// decode the payload again
+func (o *payloadOptions) validate() error {
+	if o.CRC != "" && !o.Length {
+		// Without the length, the padding in the last character
+		// can't be told apart from the data, so the CRC can't be
+		// verified
+		return errors.New("payload crc requires length")
+	}
+	return nil
+}
+
+func (o *payloadOptions) headerSize() (int, error) {
+	size := 0
+	if o.Length {
+		size += payloadLengthSize
+	}
+	if o.CRC != "" {
+		n, err := crcSize(o.CRC)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// payload represents data that spans as many consecutive characters
+// as required. In YAML, it's declared using the payload key in the
+// first character:
+//
+//	200:
+//	  payload:
+//	    length: true # optional
+//	    crc: crc32 # optional, crc16 or crc32, requires length
+//	    data:
+//	      - s: "A long string"
+//	      - file: table.bin
+type payload struct {
+	Options payloadOptions
+	Data    []byte
+}
+
+func parsePayload(v interface{}, ec *extraDataContext) (*payload, error) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("payload must be a map, it's %T", v)
+	}
+	p := &payload{}
+	for k, v := range m {
+		switch k {
+		case "length":
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("payload length must be a boolean, it's %T", v)
+			}
+			p.Options.Length = b
+		case "crc":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("payload crc must be a string, it's %T", v)
+			}
+			if _, err := crcSize(s); err != nil {
+				return nil, err
+			}
+			p.Options.CRC = s
+		case "data":
+		default:
+			return nil, fmt.Errorf("unknown key %v in payload", k)
+		}
+	}
+	if err := p.Options.validate(); err != nil {
+		return nil, err
+	}
+	var c charBinaryData
+	if err := c.addValues(m, "data", ec, &p.Data); err != nil {
+		return nil, err
+	}
+	if len(c.Computed) > 0 {
+		return nil, errors.New("computed values are not supported in payloads")
+	}
+	if len(p.Data) == 0 {
+		return nil, errors.New("payload is empty")
+	}
+	if p.Options.Length && len(p.Data) > math.MaxUint16 {
+		return nil, fmt.Errorf("payload with %d bytes is too big for its length header", len(p.Data))
+	}
+	return p, nil
+}
+
+// Bytes returns the payload with its headers
+func (p *payload) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if p.Options.Length {
+		if err := binary.Write(&buf, binary.LittleEndian, uint16(len(p.Data))); err != nil {
+			return nil, err
+		}
+	}
+	if p.Options.CRC != "" {
+		crc, err := crcBytes(p.Options.CRC, p.Data, binary.LittleEndian)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := buf.Write(crc); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := buf.Write(p.Data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Chunks splits the payload, including its headers, into
+// the data for each character.
+func (p *payload) Chunks() ([][]byte, error) {
+	data, err := p.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := mcm.CharBytes
+		if n > len(data) {
+			n = len(data)
+		}
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks, nil
+}
+
+// decodePayload reassembles a payload starting at character start. If
+// opts.Length is true, the number of characters is determined from
+// the header. Otherwise, count characters are read, including any
+// padding at the end of the last one. If opts.CRC is non empty, the
+// CRC is verified.
+func decodePayload(chars []*mcm.Char, start int, count int, opts *payloadOptions) ([]byte, error) {
+	if start < 0 || start >= len(chars) {
+		return nil, fmt.Errorf("payload start %d is out of bounds, font has %d characters", start, len(chars))
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	var data []byte
+	hdrSize, err := opts.headerSize()
+	if err != nil {
+		return nil, err
+	}
+	size := -1
+	if opts.Length {
+		hdr := chars[start].Data()
+		size = hdrSize + int(binary.LittleEndian.Uint16(hdr))
+	} else {
+		if count <= 0 {
+			return nil, errors.New("payload without a length header requires a character count")
+		}
+		size = count * mcm.CharBytes
+	}
+	for ii := start; len(data) < size; ii++ {
+		if ii >= len(chars) {
+			return nil, fmt.Errorf("payload with %d bytes starting at %d exceeds the font size", size, start)
+		}
+		data = append(data, chars[ii].Data()...)
+	}
+	data = data[:size]
+	payloadData := data[hdrSize:]
+	if opts.CRC != "" {
+		crcStart := payloadLengthSize
+		crc, err := crcBytes(opts.CRC, payloadData, binary.LittleEndian)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(crc, data[crcStart:crcStart+len(crc)]) {
+			return nil, fmt.Errorf("payload %s mismatch, stored %x, computed %x", opts.CRC, data[crcStart:crcStart+len(crc)], crc)
+		}
+	}
+	return payloadData, nil
+}
+
+func extractPayloadAction(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return errors.New("extract-payload requires 2 arguments, see help extract-payload")
+	}
+	start, err := parseCharNum(ctx.String("start"))
+	if err != nil {
+		return fmt.Errorf("invalid start character %q: %v", ctx.String("start"), err)
+	}
+	opts := &payloadOptions{
+		Length: ctx.Bool("length"),
+		CRC:    ctx.String("crc"),
+	}
+	dec, err := decodeMCMFile(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	data, err := decodePayload(decoderChars(dec), start, ctx.Int("count"), opts)
+	if err != nil {
+		return err
+	}
+	return writeOutputFile(ctx.Args().Get(1), data)
+}
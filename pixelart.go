@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fiam/max7456tool/mcm"
+)
+
+const (
+	pixelArtBlack       = 'X'
+	pixelArtWhite       = '#'
+	pixelArtTransparent = '.'
+	pixelArtGray        = 'g'
+)
+
+// pixelArtError is an error in a pixels entry. Row and Column start
+// at 1, and they're zero if the error is not specific to a row or
+// a column.
+type pixelArtError struct {
+	Row    int
+	Column int
+	Err    error
+}
+
+func (e *pixelArtError) Error() string {
+	switch {
+	case e.Column > 0:
+		return fmt.Sprintf("pixels row %d, column %d: %v", e.Row, e.Column, e.Err)
+	case e.Row > 0:
+		return fmt.Sprintf("pixels row %d %v", e.Row, e.Err)
+	}
+	return fmt.Sprintf("pixels %v", e.Err)
+}
+
+// parsePixelArt parses the argument to a pixels entry, which contains
+// a row per string, each one with a symbol per pixel:
+//
+//	pixels:
+//	  - "............"
+//	  - "....XXXX...."
+//	  - "...X####X..."
+//	  ...
+//
+// X is black, # is white, . is transparent and g is gray. Rows
+// can also be given as a single string with a row per line.
+func parsePixelArt(v interface{}) (*mcm.Pixels, error) {
+	var rows []string
+	switch x := v.(type) {
+	case string:
+		rows = strings.Split(strings.TrimRight(x, "\n"), "\n")
+	case []interface{}:
+		for ii, r := range x {
+			s, ok := r.(string)
+			if !ok {
+				return nil, &pixelArtError{Row: ii + 1, Err: fmt.Errorf("is not a string, it's %T", r)}
+			}
+			rows = append(rows, s)
+		}
+	default:
+		return nil, fmt.Errorf("argument to pixels must be a list of strings, it's %T", v)
+	}
+	if len(rows) != mcm.CharHeight {
+		return nil, &pixelArtError{Err: fmt.Errorf("has %d rows, expecting %d", len(rows), mcm.CharHeight)}
+	}
+	var pixels mcm.Pixels
+	for y, row := range rows {
+		if n := utf8.RuneCountInString(row); n != mcm.CharWidth {
+			return nil, &pixelArtError{Row: y + 1, Err: fmt.Errorf("has %d columns, expecting %d", n, mcm.CharWidth)}
+		}
+		x := 0
+		for _, r := range row {
+			switch r {
+			case pixelArtBlack:
+				pixels[y][x] = mcm.PixelBlack
+			case pixelArtWhite:
+				pixels[y][x] = mcm.PixelWhite
+			case pixelArtTransparent:
+				pixels[y][x] = mcm.PixelTransparent
+			case pixelArtGray:
+				pixels[y][x] = mcm.PixelGray
+			default:
+				return nil, &pixelArtError{Row: y + 1, Column: x + 1, Err: fmt.Errorf("invalid symbol %q, must be one of %c%c%c%c",
+					r, pixelArtTransparent, pixelArtWhite, pixelArtBlack, pixelArtGray)}
+			}
+			x++
+		}
+	}
+	return &pixels, nil
+}
+
+// formatPixelArt returns the rows for a pixels entry representing
+// the visible pixels in c.
+func formatPixelArt(c *mcm.Char) []string {
+	pixels := c.Pixels()
+	rows := make([]string, mcm.CharHeight)
+	for y := range pixels {
+		var row []byte
+		for _, p := range pixels[y] {
+			switch p {
+			case mcm.PixelBlack:
+				row = append(row, pixelArtBlack)
+			case mcm.PixelWhite:
+				row = append(row, pixelArtWhite)
+			case mcm.PixelTransparent:
+				row = append(row, pixelArtTransparent)
+			case mcm.PixelGray:
+				row = append(row, pixelArtGray)
+			}
+		}
+		rows[y] = string(row)
+	}
+	return rows
+}
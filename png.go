@@ -23,8 +23,26 @@ func buildPNGFromMCM(ctx *cli.Context, output string, input string) error {
 	if err != nil {
 		return err
 	}
-	cols := ctx.Int("columns")
-	margin := ctx.Int("margin")
+	img := mcmImage(dec, ctx.Int("columns"), ctx.Int("margin"))
+
+	// Save to png
+	f, err := openOutputFile(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// mcmImage draws all the characters in dec in a grid with the
+// given number of columns, separated by margin black pixels
+func mcmImage(dec *mcm.Decoder, cols int, margin int) *image.RGBA {
 	rows := int(math.Ceil(float64(dec.NChars()) / float64(cols)))
 	imageWidth := (mcm.CharWidth+margin)*cols + margin
 	imageHeight := (mcm.CharHeight+margin)*rows + margin
@@ -75,19 +93,7 @@ func buildPNGFromMCM(ctx *cli.Context, output string, input string) error {
 		}
 	}
 
-	// Save to png
-	f, err := openOutputFile(output)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if err := png.Encode(f, img); err != nil {
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
-	}
-	return nil
+	return img
 }
 
 func pngAction(ctx *cli.Context) error {
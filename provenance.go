@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	// originImage is a character loaded from a PNG in a directory,
+	// either with a single character or several of them
+	originImage = "image"
+	// originSheet is a character loaded from a PNG with the whole font
+	originSheet = "sheet"
+	// originParent is a character filled from a parent font
+	originParent = "parent"
+	// originExtraData is a character created from the extra data
+	originExtraData = "extra-data"
+	// originBlank is a missing character filled with a blank one
+	originBlank = "blank"
+)
+
+// charCell is the position of a character inside an image, both
+// as a column and row and as the pixel of its top left corner
+type charCell struct {
+	Column int `json:"column"`
+	Row    int `json:"row"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+}
+
+// charProvenance records where a character in a built font came from
+type charProvenance struct {
+	Char   int    `json:"char"`
+	Source string `json:"source"`
+	// File and Cell are only set for images
+	File string    `json:"file,omitempty"`
+	Cell *charCell `json:"cell,omitempty"`
+	// Parent is the name of the parent font for characters
+	// filled from a parent
+	Parent string `json:"parent,omitempty"`
+	// ExtraData contains the byte ranges from the extra data
+	// applied to the character, with their file and line
+	ExtraData []string `json:"extra_data,omitempty"`
+	// MetadataMerged is true when metadata from the extra data
+	// was merged into a character from another source
+	MetadataMerged bool `json:"metadata_merged"`
+	// Hash is the SHA-256 of the final 64 bytes of the character
+	Hash string `json:"hash"`
+}
+
+// fontProvenance maps each character to its origin while
+// a font is being built
+type fontProvenance map[int]*charProvenance
+
+// Report returns the provenance of all the characters in the font,
+// marking the missing ones as blank when fill is true
+func (p fontProvenance) Report(font string, input string, chars charMap, charNum int, fill bool) *fontProvenanceReport {
+	report := &fontProvenanceReport{Font: font, Input: input}
+	for ii := 0; ii < charNum; ii++ {
+		chr := chars[ii]
+		prov := p[ii]
+		if chr == nil {
+			if !fill {
+				continue
+			}
+			chr = blankChar()
+			prov = &charProvenance{Source: originBlank}
+		}
+		if prov == nil {
+			// Shouldn't happen, but don't lose the character
+			prov = &charProvenance{}
+		}
+		prov.Char = ii
+		sum := sha256.Sum256(chr.Data())
+		prov.Hash = hex.EncodeToString(sum[:])
+		report.Chars = append(report.Chars, prov)
+	}
+	return report
+}
+
+// fontProvenanceReport is the provenance of all the characters in a font
+type fontProvenanceReport struct {
+	Font  string            `json:"font"`
+	Input string            `json:"input"`
+	Chars []*charProvenance `json:"chars"`
+}
+
+// provenanceReport collects the provenance of the built fonts,
+// written as JSON once all of them have been built
+type provenanceReport struct {
+	w     io.Writer
+	mu    sync.Mutex
+	fonts []*fontProvenanceReport
+}
+
+func newProvenanceReport(w io.Writer) *provenanceReport {
+	return &provenanceReport{w: w}
+}
+
+// Add adds a font to the report. It's safe to call it from multiple
+// goroutines.
+func (r *provenanceReport) Add(font *fontProvenanceReport) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fonts = append(r.fonts, font)
+}
+
+// Write writes the fonts added to the report, sorted by name
+func (r *provenanceReport) Write() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.Slice(r.fonts, func(i, j int) bool {
+		return r.fonts[i].Font < r.fonts[j].Font
+	})
+	data := struct {
+		Fonts []*fontProvenanceReport `json:"fonts"`
+	}{
+		Fonts: append([]*fontProvenanceReport{}, r.fonts...),
+	}
+	enc := json.NewEncoder(r.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
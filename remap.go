@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fiam/max7456tool/mcm"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// remapEntry moves Count characters starting at Source
+// to the ones starting at Target.
+type remapEntry struct {
+	Source int
+	Target int
+	Count  int
+	// Line or item in the mapping file, used for error messages
+	Pos string
+}
+
+// parseRemapEndpoint parses a character number, a range or a symbol
+// name (if symbols is non nil) used in a remap file.
+func parseRemapEndpoint(s string, symbols *symbolTable) (first int, last int, err error) {
+	s = strings.TrimSpace(s)
+	if symbols != nil {
+		if n, found := symbols.Lookup(s); found {
+			return n, n, nil
+		}
+	}
+	return parseCharRange(s, mcm.ExtendedCharNum)
+}
+
+func newRemapEntry(source string, target string, pos string, sourceSymbols, targetSymbols *symbolTable) (*remapEntry, error) {
+	sf, sl, err := parseRemapEndpoint(source, sourceSymbols)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid source: %v", pos, err)
+	}
+	tf, tl, err := parseRemapEndpoint(target, targetSymbols)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid target: %v", pos, err)
+	}
+	count := sl - sf + 1
+	if tl != tf && tl-tf+1 != count {
+		return nil, fmt.Errorf("%s: source %s has %d characters while target %s has %d", pos, source, count, target, tl-tf+1)
+	}
+	if tf+count > mcm.ExtendedCharNum {
+		return nil, fmt.Errorf("%s: target %s with %d characters is out of bounds", pos, target, count)
+	}
+	return &remapEntry{Source: sf, Target: tf, Count: count, Pos: pos}, nil
+}
+
+// loadRemapFile loads a mapping from a YAML or a CSV file. In YAML,
+// each key is a source and each value a target. In CSV, each line
+// contains source,target. Sources and targets might be character
+// numbers, ranges or symbol names, when a symbol table is provided.
+// If a range is mapped to a single character, that character is
+// used as the start of the target range.
+func loadRemapFile(filename string, sourceSymbols, targetSymbols *symbolTable) ([]*remapEntry, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*remapEntry
+	if strings.ToLower(filepath.Ext(filename)) == ".csv" {
+		for ii, line := range strings.Split(string(data), "\n") {
+			if p := strings.IndexByte(line, '#'); p >= 0 {
+				line = line[:p]
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			pos := fmt.Sprintf("%s:%d", filename, ii+1)
+			fields := strings.Split(line, ",")
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s: expecting source,target, got %d fields", pos, len(fields))
+			}
+			e, err := newRemapEntry(fields[0], fields[1], pos, sourceSymbols, targetSymbols)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		}
+		return entries, nil
+	}
+	// Decode just the document, to keep the order of the entries
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filename, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("error parsing %s: mapping must be a map", filename)
+	}
+	for ii := 0; ii+1 < len(root.Content); ii += 2 {
+		key, value := root.Content[ii], root.Content[ii+1]
+		pos := fmt.Sprintf("%s:%d", filename, key.Line)
+		if key.Kind != yaml.ScalarNode || value.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%s: sources and targets must be scalars", pos)
+		}
+		e, err := newRemapEntry(key.Value, value.Value, pos, sourceSymbols, targetSymbols)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func remapAction(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return errors.New("remap requires 2 arguments, see help remap")
+	}
+	mapFile := ctx.String("map")
+	if mapFile == "" {
+		return errors.New("remap requires a mapping file, use --map")
+	}
+	var sourceSymbols, targetSymbols *symbolTable
+	var err error
+	if fw := ctx.String("from"); fw != "" {
+		if sourceSymbols, err = loadSymbolTable(fw); err != nil {
+			return err
+		}
+	}
+	if fw := ctx.String("to"); fw != "" {
+		if targetSymbols, err = loadSymbolTable(fw); err != nil {
+			return err
+		}
+	}
+	entries, err := loadRemapFile(mapFile, sourceSymbols, targetSymbols)
+	if err != nil {
+		return err
+	}
+	input := ctx.Args().Get(0)
+	output := ctx.Args().Get(1)
+	dec, err := decodeMCMFile(input)
+	if err != nil {
+		return err
+	}
+
+	chars := make(charMap)
+	mapped := make(map[int]bool)
+	targetSources := make(map[int]int)
+	for _, e := range entries {
+		for ii := 0; ii < e.Count; ii++ {
+			src := e.Source + ii
+			dst := e.Target + ii
+			if src >= dec.NChars() {
+				return fmt.Errorf("%s: source character %d is out of bounds, %s has %d characters", e.Pos, src, input, dec.NChars())
+			}
+			mapped[src] = true
+			if prev, found := targetSources[dst]; found {
+				fmt.Printf("%s: collision in target %s, already mapped from %s, ignoring %s\n",
+					e.Pos, targetSymbols.describe(dst), sourceSymbols.describe(prev), sourceSymbols.describe(src))
+				continue
+			}
+			targetSources[dst] = src
+			chr := dec.CharAt(src)
+			if chr.IsBlank() && chr.MetadataIsBlank() {
+				logVerbose("%s: source %s for target %s is blank", e.Pos, sourceSymbols.describe(src), targetSymbols.describe(dst))
+				continue
+			}
+			logDebug("moving character %03d to %03d", src, dst)
+			chars[dst] = chr
+		}
+	}
+	for ii := 0; ii < dec.NChars(); ii++ {
+		if !mapped[ii] && !dec.CharAt(ii).IsBlank() {
+			fmt.Printf("%s: source character %s is not mapped\n", input, sourceSymbols.describe(ii))
+		}
+	}
+	if base := ctx.String("base"); base != "" {
+		bdec, err := decodeMCMFile(base)
+		if err != nil {
+			return err
+		}
+		filled := 0
+		for ii := 0; ii < bdec.NChars(); ii++ {
+			if chars[ii] == nil && !bdec.CharAt(ii).IsBlank() {
+				logVerbose("filling character %03d from base font %s", ii, base)
+				chars[ii] = bdec.CharAt(ii)
+				filled++
+			}
+		}
+		fmt.Printf("%s: filled %d characters from %s\n", output, filled, base)
+	}
+	// Report the targets that are still empty, either mapped from
+	// a blank character or declared in the target symbol table
+	targets := make(map[int]bool, len(targetSources))
+	for dst := range targetSources {
+		targets[dst] = true
+	}
+	if targetSymbols != nil {
+		for _, n := range targetSymbols.Indices() {
+			targets[n] = true
+		}
+	}
+	var empty []int
+	for n := range targets {
+		if chars[n] == nil {
+			empty = append(empty, n)
+		}
+	}
+	sort.Ints(empty)
+	for _, n := range empty {
+		if src, found := targetSources[n]; found {
+			fmt.Printf("%s: target %s left empty, source %s is blank\n", output, targetSymbols.describe(n), sourceSymbols.describe(src))
+		} else {
+			fmt.Printf("%s: target %s left empty, it's not mapped\n", output, targetSymbols.describe(n))
+		}
+	}
+	return buildMCM(output, &mcm.Encoder{Chars: chars, Fill: true})
+}
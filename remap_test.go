@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadRemapFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool-remap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeSymbols := func(name string, data string) *symbolTable {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		st, err := loadSymbolTable(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	from := writeSymbols("from.yaml", "SYM_RSSI: 0x01\n")
+	to := writeSymbols("to.yaml", "SYM_RSSI: 0x10\n")
+	testCases := []struct {
+		name     string
+		data     string
+		from     *symbolTable
+		to       *symbolTable
+		expected []remapEntry
+		err      bool
+	}{
+		{
+			name:     "map.yaml",
+			data:     "1: 2\n0x10-0x12: 0x20\n",
+			expected: []remapEntry{{Source: 1, Target: 2, Count: 1}, {Source: 16, Target: 32, Count: 3}},
+		},
+		{
+			name:     "map.yaml",
+			data:     "10-12: 20-22\n",
+			expected: []remapEntry{{Source: 10, Target: 20, Count: 3}},
+		},
+		{
+			name: "map.yaml",
+			data: "10-12: 20-21\n",
+			err:  true,
+		},
+		{
+			name:     "map.yaml",
+			data:     "SYM_RSSI: SYM_RSSI\n",
+			from:     from,
+			to:       to,
+			expected: []remapEntry{{Source: 1, Target: 16, Count: 1}},
+		},
+		{
+			name: "map.yaml",
+			data: "SYM_RSSI: 5\n",
+			err:  true,
+		},
+		{
+			name:     "map.csv",
+			data:     "# source,target\n1,2\n\nSYM_RSSI, 0x30-0x30\n",
+			from:     from,
+			expected: []remapEntry{{Source: 1, Target: 2, Count: 1}, {Source: 1, Target: 48, Count: 1}},
+		},
+		{
+			name: "map.csv",
+			data: "1,2,3\n",
+			err:  true,
+		},
+		{
+			name: "map.csv",
+			data: "0x1f0-0x1ff,0x1fe\n",
+			err:  true,
+		},
+	}
+	for _, tc := range testCases {
+		filename := filepath.Join(dir, tc.name)
+		if err := ioutil.WriteFile(filename, []byte(tc.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := loadRemapFile(filename, tc.from, tc.to)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expecting an error loading %q", tc.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error loading %q: %v", tc.data, err)
+			continue
+		}
+		var got []remapEntry
+		for _, e := range entries {
+			got = append(got, remapEntry{Source: e.Source, Target: e.Target, Count: e.Count})
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("loading %q: expecting %+v, got %+v", tc.data, tc.expected, got)
+		}
+	}
+}
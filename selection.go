@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseCharSelection parses a list of character numbers separated by commas.
+// Each item might be either a single character or an inclusive range like
+// 16-31. Numbers can be written in decimal or in hex with the 0x prefix.
+// If s is empty, all characters in [0, max) are returned. The returned
+// slice is sorted and contains no duplicates.
+func parseCharSelection(s string, max int) ([]int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		all := make([]int, max)
+		for ii := range all {
+			all[ii] = ii
+		}
+		return all, nil
+	}
+	seen := make(map[int]bool)
+	var nums []int
+	for _, item := range strings.Split(s, ",") {
+		first, last, err := parseCharRange(item, max)
+		if err != nil {
+			return nil, err
+		}
+		for ii := first; ii <= last; ii++ {
+			if !seen[ii] {
+				seen[ii] = true
+				nums = append(nums, ii)
+			}
+		}
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+// parseCharRange parses either a single character number or an inclusive
+// range of them, returning the first and last characters. If the range
+// contains any characters >= max, an error is returned.
+func parseCharRange(item string, max int) (first int, last int, err error) {
+	item = strings.TrimSpace(item)
+	parts := strings.SplitN(item, "-", 2)
+	if first, err = parseCharNum(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("invalid character selection %q: %v", item, err)
+	}
+	last = first
+	if len(parts) == 2 {
+		if last, err = parseCharNum(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid character selection %q: %v", item, err)
+		}
+	}
+	if last < first {
+		return 0, 0, fmt.Errorf("invalid character range %q, end is lower than start", item)
+	}
+	if last >= max {
+		return 0, 0, fmt.Errorf("character selection %q is out of bounds, max is %d", item, max-1)
+	}
+	return first, last, nil
+}
+
+func parseCharNum(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	base := 10
+	if strings.HasPrefix(strings.ToLower(s), "0x") {
+		base = 16
+		s = s[2:]
+	}
+	n, err := strconv.ParseUint(s, base, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// typesKey is the top level key used to declare struct
+	// types in extra data files
+	typesKey = "types"
+)
+
+// isBuiltinEntryType returns true iff typ can be used as a key
+// for an entry in the extra data without declaring it
+func isBuiltinEntryType(typ string) bool {
+	if entryTypes[typ] != nil {
+		return true
+	}
+	fp, _ := parseFixedPointType(typ)
+	return fp != nil
+}
+
+// structEntry is an entry in a struct type. If Field is empty, the
+// entry is a constant with the given Value. Otherwise, it's a field
+// which takes its value from each character, with Value used as the
+// default if HasDefault is true.
+type structEntry struct {
+	Field      string
+	Type       string
+	Value      interface{}
+	HasDefault bool
+	// Size is used for decoding fields without a fixed size
+	// (e.g. strings). If zero, the size is determined from
+	// the default value.
+	Size int
+}
+
+// structType is a layout declared once in the types section of an
+// extra data file and used by any number of characters:
+//
+//	types:
+//	  offset:
+//	    - s: 'o'
+//	    - field: {name: x, type: i8}
+//	    - field: {name: y, type: i8, default: 0}
+//	46:
+//	  metadata:
+//	    - offset: {x: 13, y: 3}
+//
+// Entries without the field key are constants. Field types might
+// also be other struct types, in which case their value is a map.
+type structType struct {
+	Name    string
+	Entries []*structEntry
+}
+
+// parseStructTypes parses the types section of an extra data file
+func parseStructTypes(v interface{}, source *yamlFile) (map[string]*structType, error) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, source.Wrap(fmt.Errorf("%s must be a map, it's %T", typesKey, v), typesKey)
+	}
+	types := make(map[string]*structType, len(m))
+	for k, v := range m {
+		name, ok := k.(string)
+		if !ok {
+			return nil, source.Wrap(fmt.Errorf("type name %v is not a string, it's %T", k, k), typesKey, k)
+		}
+		if isBuiltinEntryType(name) {
+			return nil, source.Wrap(fmt.Errorf("type %s conflicts with a builtin type", name), typesKey, name)
+		}
+		st, err := parseStructType(name, v)
+		if err != nil {
+			return nil, source.Wrap(err, typesKey, name)
+		}
+		types[name] = st
+	}
+	for _, st := range types {
+		if err := st.check(types, nil); err != nil {
+			return nil, source.Wrap(err, typesKey, st.Name)
+		}
+	}
+	return types, nil
+}
+
+func parseStructType(name string, v interface{}) (*structType, error) {
+	entries, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("type %s must be a list, it's %T", name, v)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("type %s has no entries", name)
+	}
+	st := &structType{Name: name}
+	fields := make(map[string]bool)
+	for ii, e := range entries {
+		em, ok := e.(map[interface{}]interface{})
+		if !ok || len(em) != 1 {
+			return nil, fmt.Errorf("type %s, entry %d must be a map with a single key", name, ii+1)
+		}
+		for k, v := range em {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("type %s, entry %d: key %v is not a string, it's %T", name, ii+1, k, k)
+			}
+			if ks != "field" {
+				st.Entries = append(st.Entries, &structEntry{Type: ks, Value: v})
+				continue
+			}
+			entry, err := parseStructField(v)
+			if err != nil {
+				return nil, fmt.Errorf("type %s, entry %d: %v", name, ii+1, err)
+			}
+			if fields[entry.Field] {
+				return nil, fmt.Errorf("type %s, entry %d: duplicate field %s", name, ii+1, entry.Field)
+			}
+			fields[entry.Field] = true
+			st.Entries = append(st.Entries, entry)
+		}
+	}
+	return st, nil
+}
+
+func parseStructField(v interface{}) (*structEntry, error) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("field must be a map, it's %T", v)
+	}
+	entry := &structEntry{}
+	for k, v := range m {
+		switch k {
+		case "name":
+			entry.Field = fmt.Sprint(v)
+		case "type":
+			entry.Type = fmt.Sprint(v)
+		case "default":
+			entry.Value = v
+			entry.HasDefault = true
+		case "size":
+			n, err := toInt64(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size: %v", err)
+			}
+			if n < 1 {
+				return nil, fmt.Errorf("invalid size %d", n)
+			}
+			entry.Size = int(n)
+		default:
+			return nil, fmt.Errorf("unknown key %v in field", k)
+		}
+	}
+	if entry.Field == "" {
+		return nil, errors.New("field requires a name")
+	}
+	if entry.Type == "" {
+		return nil, fmt.Errorf("field %s requires a type", entry.Field)
+	}
+	return entry, nil
+}
+
+// check verifies that all the types used by st are declared and
+// that there are no cycles. parents contains the names of the
+// types that include st.
+func (st *structType) check(types map[string]*structType, parents []string) error {
+	for _, p := range parents {
+		if p == st.Name {
+			return fmt.Errorf("type %s includes itself", st.Name)
+		}
+	}
+	parents = append(parents, st.Name)
+	for _, e := range st.Entries {
+		if isBuiltinEntryType(e.Type) {
+			continue
+		}
+		other := types[e.Type]
+		if other == nil {
+			return fmt.Errorf("type %s uses unknown type %s", st.Name, e.Type)
+		}
+		if err := other.check(types, parents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expand returns the entries of the struct with the fields
+// taking their values from v, which must be a map. Unknown
+// fields and fields without a value nor a default are
+// rejected. The returned entries can be encoded with
+// charBinaryData.addValues.
+func (st *structType) Expand(v interface{}) ([]interface{}, error) {
+	values := make(map[string]interface{})
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		// Keys are normalized to strings, since YAML might
+		// decode names like y or on as booleans
+		for k, v := range x {
+			values[fmt.Sprint(k)] = v
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("value for %s must be a map, it's %T", st.Name, v)
+	}
+	var unknown []string
+	for k := range values {
+		if st.field(k) == nil {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown fields %v in %s", unknown, st.Name)
+	}
+	var entries []interface{}
+	for _, e := range st.Entries {
+		value := e.Value
+		if e.Field != "" {
+			fv, found := values[e.Field]
+			if !found {
+				if !e.HasDefault {
+					return nil, fmt.Errorf("missing field %s in %s", e.Field, st.Name)
+				}
+				fv = e.Value
+			}
+			value = fv
+			if e.Type == "s" && e.Size > 0 {
+				// Fixed size strings are padded with NULs
+				s := fmt.Sprint(fv)
+				if len(s) > e.Size {
+					return nil, fmt.Errorf("field %s in %s is %d bytes long, maximum is %d", e.Field, st.Name, len(s), e.Size)
+				}
+				value = s + strings.Repeat("\x00", e.Size-len(s))
+			}
+		}
+		entries = append(entries, map[interface{}]interface{}{e.Type: value})
+	}
+	return entries, nil
+}
+
+func (st *structType) field(name string) *structEntry {
+	for _, e := range st.Entries {
+		if e.Field == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// decodeSchema returns the schema value for decoding the entry
+// e. For fields, it's either their size or their default value.
+func (e *structEntry) decodeSchema() interface{} {
+	if e.Field == "" {
+		return e.Value
+	}
+	if e.Size > 0 {
+		return e.Size
+	}
+	return e.Value
+}
+
+// decodeStruct decodes a value of type st from data, returning
+// the field values and the number of bytes used. Constants are
+// verified against the declaration.
+func (d *dataDecoder) decodeStruct(st *structType, data []byte) (yamlMap, int, error) {
+	var fields yamlMap
+	pos := 0
+	for _, e := range st.Entries {
+		value, n, err := d.decodeEntry(e.Type, e.decodeSchema(), data[pos:])
+		if err != nil {
+			if e.Field != "" {
+				return nil, 0, fmt.Errorf("%s.%s: %v", st.Name, e.Field, err)
+			}
+			return nil, 0, fmt.Errorf("%s: %v", st.Name, err)
+		}
+		pos += n
+		if e.Field == "" {
+			if !entryValueEqual(value, e.Type, e.Value) {
+				logVerbose("constant %s in %s doesn't match, declared %v, stored %v", e.Type, st.Name, e.Value, value)
+			}
+			continue
+		}
+		var fv interface{}
+		if m, ok := value.(map[string]interface{}); ok {
+			fv = m[e.Type]
+		}
+		if s, ok := fv.(string); ok && e.Type == "s" && e.Size > 0 {
+			fv = strings.TrimRight(s, "\x00")
+		}
+		fields = append(fields, yamlMapItem{Key: e.Field, Value: fv})
+	}
+	return fields, pos, nil
+}
+
+// entryValueEqual returns true if the decoded entry matches
+// the value declared in the schema
+func entryValueEqual(decoded interface{}, typ string, value interface{}) bool {
+	m, ok := decoded.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	dv, found := m[typ]
+	if !found {
+		// Decoded with a different type (e.g. mismatched checksum)
+		return false
+	}
+	return fmt.Sprint(dv) == fmt.Sprint(value)
+}
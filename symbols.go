@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fiam/max7456tool/mcm"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	firmwareDirEnv     = "MAX7456TOOL_FIRMWARE_DIR"
+	defaultFirmwareDir = "firmware"
+)
+
+// symbolTable maps the symbol names used by a firmware
+// (e.g. SYM_RSSI) to their character indices. Symbol
+// tables are stored as YAML files with a symbol per key:
+//
+//	SYM_RSSI: 0x01
+//	SYM_BATT_FULL: 0x90
+type symbolTable struct {
+	Name    string
+	symbols map[string]int
+}
+
+func loadSymbolTable(filename string) (*symbolTable, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error parsing symbol table %s: %v", filename, err)
+	}
+	ext := filepath.Ext(filename)
+	t := &symbolTable{
+		Name:    filepath.Base(filename[:len(filename)-len(ext)]),
+		symbols: make(map[string]int, len(m)),
+	}
+	for k, v := range m {
+		var n int
+		switch x := v.(type) {
+		case int:
+			n = x
+		case string:
+			if n, err = parseCharNum(x); err != nil {
+				return nil, fmt.Errorf("invalid index %q for symbol %s in %s: %v", x, k, filename, err)
+			}
+		default:
+			return nil, fmt.Errorf("invalid index for symbol %s in %s, it's %T", k, filename, v)
+		}
+		if n < 0 || n >= mcm.ExtendedCharNum {
+			return nil, fmt.Errorf("symbol %s in %s has out of bounds index %d", k, filename, n)
+		}
+		t.symbols[k] = n
+	}
+	return t, nil
+}
+
+// resolveSymbolTable loads the symbol table for the given firmware.
+// name might be either a path to a symbol table or a firmware name
+// like betaflight-4.4, which is looked up as name.yaml in dir. If dir
+// is empty, $MAX7456TOOL_FIRMWARE_DIR or ./firmware are used. No
+// tables are shipped with max7456tool, so names only resolve to the
+// tables written by the user.
+func resolveSymbolTable(name string, dir string) (*symbolTable, error) {
+	if st, err := os.Stat(name); err == nil && !st.IsDir() {
+		return loadSymbolTable(name)
+	}
+	if dir == "" {
+		dir = os.Getenv(firmwareDirEnv)
+	}
+	if dir == "" {
+		dir = defaultFirmwareDir
+	}
+	filename := filepath.Join(dir, name+".yaml")
+	if _, err := os.Stat(filename); err != nil {
+		return nil, fmt.Errorf("no symbol table found for firmware %q (tried %s), no tables are shipped with max7456tool", name, filename)
+	}
+	return loadSymbolTable(filename)
+}
+
+// Lookup returns the index for the given symbol name
+func (t *symbolTable) Lookup(name string) (int, bool) {
+	n, found := t.symbols[name]
+	return n, found
+}
+
+// Names returns the symbol names sorted by their index, then by name.
+func (t *symbolTable) Names() []string {
+	names := make([]string, 0, len(t.symbols))
+	for k := range t.symbols {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ni, nj := t.symbols[names[i]], t.symbols[names[j]]
+		if ni != nj {
+			return ni < nj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// NamesAt returns all the symbol names for the given index.
+func (t *symbolTable) NamesAt(n int) []string {
+	var names []string
+	for _, k := range t.Names() {
+		if t.symbols[k] == n {
+			names = append(names, k)
+		}
+	}
+	return names
+}
+
+// Indices returns all the indices used by the table, sorted
+// and without duplicates.
+func (t *symbolTable) Indices() []int {
+	seen := make(map[int]bool)
+	var indices []int
+	for _, n := range t.symbols {
+		if !seen[n] {
+			seen[n] = true
+			indices = append(indices, n)
+		}
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+func (t *symbolTable) describe(n int) string {
+	if t == nil {
+		return fmt.Sprintf("%03d", n)
+	}
+	if names := t.NamesAt(n); len(names) > 0 {
+		return fmt.Sprintf("%03d (%s)", n, strings.Join(names, ", "))
+	}
+	return fmt.Sprintf("%03d", n)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fiam/max7456tool/mcm"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	transformOpsUsage = `Transformation to apply, in order. Can be repeated. Valid values are:
+	flip-horizontal (or flip-h), flip-vertical (or flip-v), rotate180, invert,
+	clear-metadata, outline[:4|:8] and shift:dx,dy[,wrap|,fill=COLOR] where COLOR
+	is one of TRANSPARENT (default), BLACK, WHITE or GRAY.`
+)
+
+func parseShiftTransform(args string) (mcm.Transform, error) {
+	parts := strings.Split(args, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("shift requires dx,dy and an optional wrap or fill=COLOR, got %q", args)
+	}
+	dx, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid shift dx %q: %v", parts[0], err)
+	}
+	dy, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid shift dy %q: %v", parts[1], err)
+	}
+	wrap := false
+	fill := mcm.Pixel(mcm.PixelTransparent)
+	if len(parts) == 3 {
+		opt := strings.TrimSpace(parts[2])
+		switch {
+		case opt == "wrap":
+			wrap = true
+		case strings.HasPrefix(opt, "fill="):
+			if fill, err = parsePixelColor(opt[len("fill="):]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("invalid shift option %q, must be wrap or fill=COLOR", opt)
+		}
+	}
+	return func(c *mcm.Char) *mcm.Char {
+		return mcm.Shift(c, dx, dy, wrap, fill)
+	}, nil
+}
+
+func parseTransform(op string) (mcm.Transform, error) {
+	name := strings.ToLower(strings.TrimSpace(op))
+	var args string
+	if p := strings.IndexByte(name, ':'); p >= 0 {
+		args = name[p+1:]
+		name = name[:p]
+	}
+	switch name {
+	case "shift":
+		return parseShiftTransform(args)
+	case "outline":
+		opts := &outlineOptions{}
+		if args != "" {
+			n, err := strconv.Atoi(args)
+			if err != nil {
+				return nil, fmt.Errorf("invalid outline neighbors %q: %v", args, err)
+			}
+			opts.Neighbors = n
+		}
+		conn, err := opts.Connectivity()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *mcm.Char) *mcm.Char {
+			return mcm.Outline(c, conn)
+		}, nil
+	}
+	if args != "" {
+		return nil, fmt.Errorf("transform %q doesn't take any arguments", name)
+	}
+	switch name {
+	case "flip-horizontal", "flip-h", "mirror":
+		return mcm.FlipHorizontal, nil
+	case "flip-vertical", "flip-v":
+		return mcm.FlipVertical, nil
+	case "rotate180", "rotate-180":
+		return mcm.Rotate180, nil
+	case "invert":
+		return mcm.Invert, nil
+	case "clear-metadata":
+		return mcm.ClearMetadata, nil
+	}
+	return nil, fmt.Errorf("unknown transform %q", op)
+}
+
+// transformChars applies all the transforms in order to the
+// given characters, returning a new charMap. Characters not in
+// the selection are copied unchanged.
+func transformChars(chars charMap, selection []int, transforms []mcm.Transform) charMap {
+	result := make(charMap, len(chars))
+	for k, v := range chars {
+		result[k] = v
+	}
+	for _, n := range selection {
+		chr := result[n]
+		if chr == nil {
+			continue
+		}
+		for _, t := range transforms {
+			chr = t(chr)
+		}
+		logDebug("transformed character %03d", n)
+		result[n] = chr
+	}
+	return result
+}
+
+func transformAction(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return errors.New("transform requires 2 arguments, see help transform")
+	}
+	input := ctx.Args().Get(0)
+	output := ctx.Args().Get(1)
+	var transforms []mcm.Transform
+	for _, op := range ctx.StringSlice("op") {
+		t, err := parseTransform(op)
+		if err != nil {
+			return err
+		}
+		transforms = append(transforms, t)
+	}
+	if len(transforms) == 0 {
+		return errors.New("no transforms specified, use --op")
+	}
+	dec, err := decodeMCMFile(input)
+	if err != nil {
+		return err
+	}
+	selection, err := parseCharSelection(ctx.String("chars"), dec.NChars())
+	if err != nil {
+		return err
+	}
+	chars := transformChars(decoderCharMap(dec), selection, transforms)
+	if strings.ToLower(filepath.Ext(output)) == ".mcm" {
+		return buildMCM(output, &mcm.Encoder{Chars: chars})
+	}
+	// Write the selected characters to a directory. PNGs can't
+	// store the metadata, so refuse to lose it unless asked to.
+	dropMetadata := ctx.Bool("drop-metadata")
+	if !dropMetadata {
+		for _, n := range selection {
+			if !chars[n].MetadataIsBlank() {
+				return fmt.Errorf("character %03d has metadata, which can't be stored in a .png. Write a .mcm or use --drop-metadata", n)
+			}
+		}
+	}
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return err
+	}
+	for _, n := range selection {
+		chr := chars[n]
+		if chr.IsBlank() {
+			continue
+		}
+		filename := filepath.Join(output, fmt.Sprintf("%03d.png", n))
+		if err := writeCharPNG(filename, chr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
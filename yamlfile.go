@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	maxYAMLSnippetLength = 100
+)
+
+// yamlPosition is the position of a node in a YAML file, with both
+// Line and Column starting at 1
+type yamlPosition struct {
+	Line   int
+	Column int
+}
+
+// yamlFile keeps the positions of all the nodes in a YAML document, so
+// errors can point to them. Paths are built with yamlPath, using the
+// keys for maps and the indices for lists. For map values, the position
+// of their key is used. Map keys are decoded before building their paths,
+// so 0x2e and 46 both result in the same path.
+type yamlFile struct {
+	Name      string
+	Root      *yaml.Node
+	lines     []string
+	positions map[string]yamlPosition
+}
+
+func yamlPath(elems ...interface{}) string {
+	parts := make([]string, len(elems))
+	for ii, e := range elems {
+		parts[ii] = fmt.Sprint(e)
+	}
+	return strings.Join(parts, "/")
+}
+
+// parseYAMLFile parses the given data, read from the file name
+func parseYAMLFile(name string, data []byte) (*yamlFile, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	f := &yamlFile{
+		Name:      name,
+		lines:     strings.Split(string(data), "\n"),
+		positions: make(map[string]yamlPosition),
+	}
+	if len(doc.Content) > 0 {
+		f.Root = doc.Content[0]
+		f.add(f.Root, "", 0)
+	}
+	return f, nil
+}
+
+func (f *yamlFile) add(node *yaml.Node, path string, depth int) {
+	if node.Kind == yaml.AliasNode {
+		// Avoid looping forever with malformed documents
+		if depth > 32 || node.Alias == nil {
+			return
+		}
+		node = node.Alias
+	}
+	join := func(elem interface{}) string {
+		if path == "" {
+			return yamlPath(elem)
+		}
+		return yamlPath(path, elem)
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for ii := 0; ii+1 < len(node.Content); ii += 2 {
+			key, value := node.Content[ii], node.Content[ii+1]
+			var k interface{}
+			if err := key.Decode(&k); err != nil || k == nil {
+				k = key.Value
+			}
+			child := join(k)
+			f.positions[child] = yamlPosition{Line: key.Line, Column: key.Column}
+			f.add(value, child, depth+1)
+		}
+	case yaml.SequenceNode:
+		for ii, item := range node.Content {
+			child := join(ii)
+			f.positions[child] = yamlPosition{Line: item.Line, Column: item.Column}
+			f.add(item, child, depth+1)
+		}
+	}
+}
+
+// Value returns the node for the value of the given top level key,
+// or nil if the document is not a map or the key is not present
+func (f *yamlFile) Value(key string) *yaml.Node {
+	if f == nil || f.Root == nil || f.Root.Kind != yaml.MappingNode {
+		return nil
+	}
+	for ii := 0; ii+1 < len(f.Root.Content); ii += 2 {
+		if f.Root.Content[ii].Value == key {
+			return f.Root.Content[ii+1]
+		}
+	}
+	return nil
+}
+
+// Position returns the position for the given path. If the path is not
+// found, the position of its closest ancestor is returned.
+func (f *yamlFile) Position(elems ...interface{}) (yamlPosition, bool) {
+	if f == nil {
+		return yamlPosition{}, false
+	}
+	for n := len(elems); n > 0; n-- {
+		if pos, found := f.positions[yamlPath(elems[:n]...)]; found {
+			return pos, true
+		}
+	}
+	return yamlPosition{}, false
+}
+
+// Line returns the line for the given path, or zero if it's unknown
+func (f *yamlFile) Line(elems ...interface{}) int {
+	pos, _ := f.Position(elems...)
+	return pos.Line
+}
+
+// Wrap returns an error pointing to the node at the given path. If
+// err already points to a node, it's returned unchanged.
+func (f *yamlFile) Wrap(err error, elems ...interface{}) error {
+	if f == nil || err == nil {
+		return err
+	}
+	if _, ok := err.(*yamlError); ok {
+		return err
+	}
+	pos, found := f.Position(elems...)
+	if !found {
+		return fmt.Errorf("%s: %v", f.Name, err)
+	}
+	return &yamlError{
+		File:    f.Name,
+		Pos:     pos,
+		Snippet: f.snippet(pos),
+		Err:     err,
+	}
+}
+
+func (f *yamlFile) snippet(pos yamlPosition) string {
+	if pos.Line < 1 || pos.Line > len(f.lines) {
+		return ""
+	}
+	line := strings.TrimRight(f.lines[pos.Line-1], "\r")
+	if len(line) > maxYAMLSnippetLength {
+		line = line[:maxYAMLSnippetLength] + "..."
+	}
+	// Keep tabs in the padding, so the marker is aligned
+	var pad []rune
+	for ii, r := range line {
+		if utf8.RuneCountInString(line[:ii]) >= pos.Column-1 {
+			break
+		}
+		if r != '\t' {
+			r = ' '
+		}
+		pad = append(pad, r)
+	}
+	num := fmt.Sprint(pos.Line)
+	return fmt.Sprintf("  %s | %s\n  %s | %s^", num, line, strings.Repeat(" ", len(num)), string(pad))
+}
+
+// withContext prefixes the message of err with ctx, keeping
+// its position if it points to a node
+func withContext(err error, ctx string) error {
+	if ye, ok := err.(*yamlError); ok {
+		c := *ye
+		c.Err = fmt.Errorf("%s: %v", ctx, ye.Err)
+		return &c
+	}
+	return fmt.Errorf("%s: %v", ctx, err)
+}
+
+// yamlError is an error in a YAML file, pointing to the offending node
+type yamlError struct {
+	File    string
+	Pos     yamlPosition
+	Snippet string
+	Err     error
+}
+
+func (e *yamlError) Error() string {
+	msg := fmt.Sprintf("%s:%d:%d: %v", e.File, e.Pos.Line, e.Pos.Column, e.Err)
+	if e.Snippet != "" {
+		msg += "\n" + e.Snippet
+	}
+	return msg
+}
+
+var (
+	yamlUnmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+)
+
+// decodeYAML decodes data into generic values, see yamlNodeValue
+func decodeYAML(data []byte) (interface{}, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return yamlNodeValue(&doc)
+}
+
+// yamlMapValue decodes node, which must be either a map or empty, into
+// generic values. If node is nil, an empty map is returned.
+func yamlMapValue(node *yaml.Node) (map[interface{}]interface{}, error) {
+	if node == nil {
+		return make(map[interface{}]interface{}), nil
+	}
+	v, err := yamlNodeValue(node)
+	if err != nil {
+		return nil, err
+	}
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		return x, nil
+	case nil:
+		return make(map[interface{}]interface{}), nil
+	}
+	return nil, fmt.Errorf("expecting a map at the top level, got %T", v)
+}
+
+// yamlNodeValue decodes node into generic values. Unlike decoding into
+// an interface{}, maps are always decoded as map[interface{}]interface{},
+// since their keys might be character numbers, and timestamps are
+// kept as strings.
+func yamlNodeValue(node *yaml.Node) (interface{}, error) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlNodeValue(node.Content[0])
+	case yaml.AliasNode:
+		if node.Alias == nil {
+			return nil, fmt.Errorf("line %d: unknown alias %s", node.Line, node.Value)
+		}
+		return yamlNodeValue(node.Alias)
+	case yaml.MappingNode:
+		m := make(map[interface{}]interface{}, len(node.Content)/2)
+		// Merged maps (<<: *anchor) don't override the keys
+		// declared in the map, so add them at the end
+		var merged []interface{}
+		for ii := 0; ii+1 < len(node.Content); ii += 2 {
+			key, value := node.Content[ii], node.Content[ii+1]
+			v, err := yamlNodeValue(value)
+			if err != nil {
+				return nil, err
+			}
+			if key.Kind == yaml.ScalarNode && key.Tag == "!!merge" {
+				if items, ok := v.([]interface{}); ok {
+					merged = append(merged, items...)
+				} else {
+					merged = append(merged, v)
+				}
+				continue
+			}
+			k, err := yamlNodeValue(key)
+			if err != nil {
+				return nil, err
+			}
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, fmt.Errorf("line %d: invalid map key of type %T", key.Line, k)
+			}
+			m[k] = v
+		}
+		for _, mv := range merged {
+			mm, ok := mv.(map[interface{}]interface{})
+			if !ok {
+				return nil, fmt.Errorf("line %d: map merge requires a map, got %T", node.Line, mv)
+			}
+			for k, v := range mm {
+				if _, found := m[k]; !found {
+					m[k] = v
+				}
+			}
+		}
+		return m, nil
+	case yaml.SequenceNode:
+		items := make([]interface{}, len(node.Content))
+		for ii, item := range node.Content {
+			v, err := yamlNodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			items[ii] = v
+		}
+		return items, nil
+	}
+	if node.ShortTag() == "!!timestamp" {
+		return node.Value, nil
+	}
+	var v interface{}
+	if err := node.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// yamlMapItem is an item in a yamlMap
+type yamlMapItem struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// yamlMap is a map which keeps the order of its items when encoded
+type yamlMap []yamlMapItem
+
+func (m yamlMap) MarshalYAML() (interface{}, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, item := range m {
+		var key, value yaml.Node
+		if err := key.Encode(item.Key); err != nil {
+			return nil, err
+		}
+		if err := value.Encode(item.Value); err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, &key, &value)
+	}
+	return node, nil
+}
+
+// encodeYAML encodes v using 2 spaces for indentation
+func encodeYAML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CheckKeys verifies that all the keys in the document correspond to
+// fields in v, which must be a pointer to a struct. Types with custom
+// unmarshalers are also decoded to check for errors.
+func (f *yamlFile) CheckKeys(v interface{}) error {
+	if f.Root == nil {
+		return nil
+	}
+	return f.checkKeys(f.Root, reflect.TypeOf(v), nil)
+}
+
+func (f *yamlFile) checkKeys(node *yaml.Node, typ reflect.Type, path []interface{}) error {
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if reflect.PtrTo(typ).Implements(yamlUnmarshalerType) {
+		if err := node.Decode(reflect.New(typ).Interface()); err != nil {
+			return f.Wrap(err, path...)
+		}
+		// Structs with custom unmarshalers usually accept a map
+		// with their fields too, check their keys below
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		fields := yamlStructFields(typ)
+		for ii := 0; ii+1 < len(node.Content); ii += 2 {
+			key := node.Content[ii].Value
+			childPath := append(append([]interface{}(nil), path...), key)
+			ft, found := fields[key]
+			if !found {
+				return f.Wrap(unknownKeyError(key, fields), childPath...)
+			}
+			if err := f.checkKeys(node.Content[ii+1], ft, childPath); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for ii := 0; ii+1 < len(node.Content); ii += 2 {
+			childPath := append(append([]interface{}(nil), path...), node.Content[ii].Value)
+			if err := f.checkKeys(node.Content[ii+1], typ.Elem(), childPath); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return nil
+		}
+		for ii, item := range node.Content {
+			childPath := append(append([]interface{}(nil), path...), ii)
+			if err := f.checkKeys(item, typ.Elem(), childPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// yamlStructFields returns the types of the fields in typ,
+// indexed by the key used for them in YAML
+func yamlStructFields(typ reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for ii := 0; ii < typ.NumField(); ii++ {
+		field := typ.Field(ii)
+		if field.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+func unknownKeyError(key string, fields map[string]reflect.Type) error {
+	var names []string
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	best := ""
+	bestDistance := 3
+	for _, name := range names {
+		if d := levenshtein(key, name); d < bestDistance {
+			best = name
+			bestDistance = d
+		}
+	}
+	if best != "" {
+		return fmt.Errorf("unknown key %q, did you mean %q?", key, best)
+	}
+	return fmt.Errorf("unknown key %q, valid keys are %s", key, strings.Join(names, ", "))
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for jj := range prev {
+		prev[jj] = jj
+	}
+	for ii := 1; ii <= len(a); ii++ {
+		cur[0] = ii
+		for jj := 1; jj <= len(b); jj++ {
+			cost := 1
+			if a[ii-1] == b[jj-1] {
+				cost = 0
+			}
+			cur[jj] = prev[jj] + 1
+			if v := cur[jj-1] + 1; v < cur[jj] {
+				cur[jj] = v
+			}
+			if v := prev[jj-1] + cost; v < cur[jj] {
+				cur[jj] = v
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestYAMLErrorPositions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max7456tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "default"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name string
+		yaml string
+		err  string
+	}{
+		{name: "data.yaml", yaml: "46:\n  metadata:\n    - s: 'o'\n    - i8: 300\n", err: "data.yaml:4:7: character 46: can't encode 300 as int8\n  4 |     - i8: 300\n    |       ^"},
+		{name: "data.yaml", yaml: "46:\n  metdata: []\n", err: "data.yaml:2:3: character 46: unknown key metdata"},
+		{name: "data.yaml", yaml: "\"1-3\": {}\n\"SYM_*\": {}\n", err: "data.yaml:2:1: invalid key \"SYM_*\""},
+		{name: "data.yaml", yaml: "types:\n  a: [{field: {name: x}}]\n", err: "data.yaml:2:3: type a, entry 1: field x requires a type"},
+		{name: "data.yaml", yaml: "10:\n  payload:\n    data:\n      - u8: 1\n      - u16: 2\n", err: "data.yaml:5:9: character 10: can't encode value with key \"u16\""},
+		{name: "fonts.yaml", yaml: "preview: true\nfonts:\n  - source: default\n", err: "fonts.yaml:1:1: unknown key \"preview\", did you mean \"previews\"?"},
+		{name: "fonts.yaml", yaml: "fonts:\n  - source: default\n    outptu: x.mcm\n", err: "fonts.yaml:3:5: unknown key \"outptu\", did you mean \"output\"?"},
+		{name: "fonts.yaml", yaml: "fonts:\n  - source: default\n  - source: missing\n", err: "fonts.yaml:3:5: source \"missing\""},
+		{name: "fonts.yaml", yaml: "default: other\nfonts:\n  - source: default\n", err: "fonts.yaml:1:1: default font \"other\" not found"},
+		{name: "fonts.yaml", yaml: "fonts:\n  - source: default\n    outline: {neighbors: 5}\n", err: "fonts.yaml:3:5: invalid outline neighbors 5"},
+		{name: "fonts.yaml", yaml: "fonts:\n  - source: default\n    outline: {neighbours: 4}\n", err: "fonts.yaml:3:15: unknown key \"neighbours\", did you mean \"neighbors\"?"},
+	}
+	for _, tc := range testCases {
+		filename := filepath.Join(dir, tc.name)
+		if err := ioutil.WriteFile(filename, []byte(tc.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tc.name == "fonts.yaml" {
+			var config generateConfig
+			err = config.Load(filename, nil)
+		} else {
+			err = newFontDataSet().ParseFile(filename)
+		}
+		if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, tc.err)) {
+			t.Errorf("expecting error containing %q for %q, got %v", tc.err, tc.yaml, err)
+		}
+	}
+}
+
+func TestDecodeYAML(t *testing.T) {
+	type m = map[interface{}]interface{}
+	testCases := []struct {
+		yaml     string
+		expected interface{}
+	}{
+		{yaml: "", expected: nil},
+		{yaml: "0x2e: {a: 1}", expected: m{46: m{"a": 1}}},
+		{yaml: "a: [1, 1.5, true, ~, s]", expected: m{"a": []interface{}{1, 1.5, true, nil, "s"}}},
+		{yaml: "a: 2006-01-02", expected: m{"a": "2006-01-02"}},
+		{yaml: "a: &x {b: 1}\nc: *x", expected: m{"a": m{"b": 1}, "c": m{"b": 1}}},
+		{yaml: "a: &x {b: 1, c: 2}\nd: {<<: *x, c: 3}", expected: m{"a": m{"b": 1, "c": 2}, "d": m{"b": 1, "c": 3}}},
+	}
+	for _, tc := range testCases {
+		v, err := decodeYAML([]byte(tc.yaml))
+		if err != nil {
+			t.Errorf("error decoding %q: %v", tc.yaml, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, tc.expected) {
+			t.Errorf("decoding %q: expecting %#v, got %#v", tc.yaml, tc.expected, v)
+		}
+	}
+}
+
+func TestEncodeYAMLMap(t *testing.T) {
+	data, err := encodeYAML(yamlMap{
+		{Key: 10, Value: yamlMap{{Key: "data", Value: []interface{}{yamlMap{{Key: "u8", Value: 1}}}}}},
+		{Key: 2, Value: "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "10:\n  data:\n    - u8: 1\n2: b\n"; string(data) != expected {
+		t.Errorf("expecting %q, got %q", expected, data)
+	}
+}